@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	FENCE_COLUMN = "fence_token" // column of the fencing token in tables written with FencedUpdate
+	FENCE_SUFFIX = ".fence"      // the token of a redis key is kept in a sibling key
+)
+
+var (
+	ErrStaleToken = errors.New("fencing token older than the last writer's")
+)
+
+// sets KEYS[1] to ARGV[2] unless the token in KEYS[2] is above ARGV[1]
+var fenced_set = new_fence_script(`
+local fence = tonumber(redis.call('GET', KEYS[2]) or 0)
+local token = tonumber(ARGV[1])
+if token < fence then
+	return 0
+end
+if token > fence then
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+redis.call('SET', KEYS[1], ARGV[2])
+return 1
+`)
+
+// sets field ARGV[3] of hash KEYS[1] to ARGV[2] unless the token in KEYS[2] is above ARGV[1]
+var fenced_hset = new_fence_script(`
+local fence = tonumber(redis.call('GET', KEYS[2]) or 0)
+local token = tonumber(ARGV[1])
+if token < fence then
+	return 0
+end
+if token > fence then
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+redis.call('HSET', KEYS[1], ARGV[3], ARGV[2])
+return 1
+`)
+
+// fence_script is a script run by its sha, and sent again by its source
+// when the server does not know it
+type fence_script struct {
+	src  string
+	hash string
+}
+
+func new_fence_script(src string) *fence_script {
+	h := sha1.Sum([]byte(src))
+	return &fence_script{src: src, hash: hex.EncodeToString(h[:])}
+}
+
+// fence_key names the sibling key holding the token of key, in the same
+// cluster slot as key
+func fence_key(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 && strings.Contains(key[i+1:], "}") && key[i+1] != '}' {
+		return key + FENCE_SUFFIX
+	}
+
+	return "{" + key + "}" + FENCE_SUFFIX
+}
+
+// run_fenced runs script on key and its fence key
+func (c *RedisClient) run_fenced(ctx context.Context, script *fence_script, key string, args ...interface{}) error {
+	cmdargs := make([]interface{}, 0, 5+len(args))
+	cmdargs = append(cmdargs, "evalsha", script.hash, 2, key, fence_key(key))
+	cmdargs = append(cmdargs, args...)
+
+	cmd := redis.NewCmd(cmdargs...)
+	err := c.process(ctx, cmd)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		cmdargs[0], cmdargs[1] = "eval", script.src
+		cmd = redis.NewCmd(cmdargs...)
+		err = c.process(ctx, cmd)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cmd.Val() != int64(1) {
+		return ErrStaleToken
+	}
+
+	return nil
+}
+
+// FencedSet writes data under key as the holder of a lock with fencing
+// token, see distmutex, and returns ErrStaleToken if a holder with a higher
+// token wrote key already
+func (c *RedisClient) FencedSet(ctx context.Context, key string, token int64, data string) error {
+	return c.run_fenced(ctx, fenced_set, key, strconv.FormatInt(token, 10), data)
+}
+
+// FencedHSet is FencedSet on a field of a hash, the token covers the whole hash
+func (c *RedisClient) FencedHSet(ctx context.Context, hKey, key string, token int64, data string) error {
+	return c.run_fenced(ctx, fenced_hset, hKey, strconv.FormatInt(token, 10), data, key)
+}
+
+// RedisFencedSet is FencedSet on the client of InitRedis
+func RedisFencedSet(key string, token int64, data string) error {
+	client := DefaultRedis()
+	if client == nil {
+		return ErrUnavailable
+	}
+
+	return client.FencedSet(context.Background(), key, token, data)
+}
+
+// RedisFencedHSet is FencedHSet on the client of InitRedis
+func RedisFencedHSet(hKey, key string, token int64, data string) error {
+	client := DefaultRedis()
+	if client == nil {
+		return ErrUnavailable
+	}
+
+	return client.FencedHSet(context.Background(), hKey, key, token, data)
+}
+
+// FencedUpdate writes fields to the rows matching wheres as the holder of a
+// lock with fencing token, along with token in their FENCE_COLUMN, a NULL
+// token counts as 0. It returns ErrStaleToken, writing nothing, if a holder
+// with a higher token wrote one of them, and gorm.ErrRecordNotFound if no row
+// matches wheres.
+func FencedUpdate(model interface{}, token int64, fields, wheres map[string]interface{}) error {
+	if _gorm_db == nil {
+		return errors.New("gorm db not initialized")
+	}
+
+	updates := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		updates[k] = v
+	}
+	updates[FENCE_COLUMN] = token
+
+	tx := _gorm_db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fenced_update(tx, model, token, updates, wheres); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// fenced_update updates the rows the token is not stale for, then fails if
+// another row is stale or none matches, the caller rolls back on error
+func fenced_update(tx *gorm.DB, model interface{}, token int64, updates, wheres map[string]interface{}) error {
+	fence := "COALESCE(" + FENCE_COLUMN + ", 0)"
+	if err := tx.Model(model).Where(wheres).Where(fence+" <= ?", token).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	var rows, stale int
+	if err := tx.Model(model).Where(wheres).Count(&rows).Error; err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	if err := tx.Model(model).Where(wheres).Where(fence+" > ?", token).Count(&stale).Error; err != nil {
+		return err
+	}
+
+	if stale > 0 {
+		return ErrStaleToken
+	}
+
+	return nil
+}
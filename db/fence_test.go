@@ -0,0 +1,96 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+type fenced_row struct {
+	ID         int `gorm:"primary_key"`
+	Value      string
+	FenceToken int64
+}
+
+func TestFencedUpdate(t *testing.T) {
+	if err := FencedUpdate(&fenced_row{}, 1, nil, nil); err == nil {
+		t.Fatal("update without db")
+	}
+
+	dir, err := ioutil.TempDir("", "fence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_gorm_db, err = gorm.Open("sqlite3", dir+"/fence.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_gorm_db.Close()
+		_gorm_db = nil
+	}()
+	_gorm_db.SingularTable(true)
+	if err := _gorm_db.AutoMigrate(&fenced_row{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := _gorm_db.Create(&fenced_row{ID: 1, Value: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	row := map[string]interface{}{"id": 1}
+	for _, c := range []struct {
+		token int64
+		value string
+		err   error
+	}{
+		{2, "b", nil},
+		{2, "b", nil}, // the same values again
+		{1, "c", ErrStaleToken},
+		{3, "d", nil},
+	} {
+		if err := FencedUpdate(&fenced_row{}, c.token, map[string]interface{}{"value": c.value}, row); err != c.err {
+			t.Fatalf("token %v err %v", c.token, err)
+		}
+	}
+
+	var stored fenced_row
+	if err := _gorm_db.First(&stored, 1).Error; err != nil || stored.Value != "d" || stored.FenceToken != 3 {
+		t.Fatalf("row %+v err %v", stored, err)
+	}
+
+	// a NULL token, as in a column added to a table, counts as 0
+	if err := _gorm_db.Exec("INSERT INTO fenced_row (id, value) VALUES (?, ?)", 3, "null").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := FencedUpdate(&fenced_row{}, 1, map[string]interface{}{"value": "n"}, map[string]interface{}{"id": 3}); err != nil {
+		t.Fatal(err)
+	}
+	var null fenced_row
+	if err := _gorm_db.First(&null, 3).Error; err != nil || null.Value != "n" || null.FenceToken != 1 {
+		t.Fatalf("null row %+v err %v", null, err)
+	}
+
+	// one stale row of several fails the whole update
+	for _, r := range []fenced_row{{ID: 4, Value: "m"}, {ID: 5, Value: "m", FenceToken: 5}} {
+		if err := _gorm_db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := FencedUpdate(&fenced_row{}, 2, map[string]interface{}{"value": "x"}, map[string]interface{}{"value": "m"}); err != ErrStaleToken {
+		t.Fatalf("stale row err %v", err)
+	}
+	var beside fenced_row
+	if err := _gorm_db.First(&beside, 4).Error; err != nil || beside.Value != "m" || beside.FenceToken != 0 {
+		t.Fatalf("row beside the stale one %+v err %v", beside, err)
+	}
+
+	missing := map[string]interface{}{"id": 2}
+	if err := FencedUpdate(&fenced_row{}, 4, map[string]interface{}{"value": "e"}, missing); err != gorm.ErrRecordNotFound {
+		t.Fatalf("missing row err %v", err)
+	}
+}
@@ -3,12 +3,11 @@ module github.com/xymodule/libs/db
 go 1.13
 
 require (
-	github.com/garyburd/redigo v1.6.0 // indirect
+	github.com/alicebob/miniredis/v2 v2.17.0
+	github.com/go-redis/redis/v7 v7.4.1
 	github.com/golang/protobuf v1.3.2
 	github.com/jinzhu/gorm v1.9.11
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/sirupsen/logrus v1.4.2
-	gopkg.in/bsm/ratelimit.v1 v1.0.0-20160220154919-db14e161995a // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
-	gopkg.in/redis.v3 v3.6.4
 )
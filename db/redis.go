@@ -1,120 +1,271 @@
 package db
 
 import (
+	"context"
 	"errors"
-	"os"
 
+	"github.com/go-redis/redis/v7"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/redis.v3"
+)
+
+const (
+	REDIS_STANDALONE = "standalone"
+	REDIS_SENTINEL   = "sentinel" // failover group of a master and its replicas
+	REDIS_CLUSTER    = "cluster"
+)
+
+var (
+	ErrUnavailable = errors.New("redis service unavailable")
+	ErrNil         = errors.New("redis nil reply") // the key or field does not exist
 )
 
 var (
-	_default_redis *redis.ClusterClient
+	_default_redis *RedisClient
 )
 
-func InitRedis(hosts []string, pass string, poolsize int) {
-	log.Infof("redis hosts %v, pass %v", hosts, pass)
-	client := redis.NewClusterClient(&redis.ClusterOptions{
+// RedisConfig selects the redis deployment, an empty Mode is guessed as
+// redis.UniversalOptions does: sentinel with a MasterName, cluster with
+// several Addrs, standalone otherwise
+type RedisConfig struct {
+	Mode       string
+	Addrs      []string // the server, the sentinels or the cluster seed nodes
+	MasterName string   // of the sentinel group
+	Password   string
+	DB         int // standalone and sentinel only
+	PoolSize   int
+}
+
+// RedisClient runs the redis commands bounded by a ctx, the deadline of ctx
+// is set on the connection of each call and its cancellation is seen before
+// the command is sent
+type RedisClient struct {
+	client redis.UniversalClient
+}
+
+// NewRedisClient connects to the deployment of cfg and pings it
+func NewRedisClient(ctx context.Context, cfg RedisConfig) (*RedisClient, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:      cfg.Addrs,
+		MasterName: cfg.MasterName,
+		Password:   cfg.Password,
+		DB:         cfg.DB,
+		PoolSize:   cfg.PoolSize,
+	}
+
+	c := &RedisClient{}
+	switch cfg.Mode {
+	case REDIS_STANDALONE:
+		c.client = redis.NewClient(opts.Simple())
+	case REDIS_SENTINEL:
+		c.client = redis.NewFailoverClient(opts.Failover())
+	case REDIS_CLUSTER:
+		c.client = redis.NewClusterClient(opts.Cluster())
+	case "":
+		c.client = redis.NewUniversalClient(opts)
+	default:
+		return nil, errors.New("redis unknown mode " + cfg.Mode)
+	}
+
+	if err := c.process(ctx, redis.NewStatusCmd("ping")); err != nil {
+		c.client.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// InitRedis connects the helpers to the cluster of hosts
+func InitRedis(hosts []string, pass string, poolsize int) (err error) {
+	return InitRedisConfig(RedisConfig{
+		Mode:     REDIS_CLUSTER,
 		Addrs:    hosts,
 		Password: pass,
 		PoolSize: poolsize,
 	})
+}
 
-	pong, err := client.Ping().Result()
+// InitRedisConfig connects the helpers to the deployment of cfg
+func InitRedisConfig(cfg RedisConfig) (err error) {
+	log.Infof("redis %v hosts %v, master %v", cfg.Mode, cfg.Addrs, cfg.MasterName)
+	client, err := NewRedisClient(context.Background(), cfg)
 	if err != nil {
 		log.Errorf("Connect to redis servers failed: %v", err)
-		os.Exit(-1)
-	} else {
-		log.Info(pong)
+		return
 	}
 
 	_default_redis = client
+	return
 }
 
-func GetRedis() *redis.ClusterClient {
+// DefaultRedis returns the client of InitRedis, nil before
+func DefaultRedis() *RedisClient {
 	return _default_redis
 }
 
+func GetRedis() redis.UniversalClient {
+	if _default_redis == nil {
+		return nil
+	}
+
+	return _default_redis.client
+}
+
 func IsNilReply(err error) bool {
-	return err == redis.Nil
+	return err == ErrNil || err == redis.Nil
+}
+
+func redis_err(err error) error {
+	if err == redis.Nil {
+		return ErrNil
+	}
+
+	return err
+}
+
+func (c *RedisClient) process(ctx context.Context, cmd redis.Cmder) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return redis_err(c.client.ProcessContext(ctx, cmd))
+}
+
+// Redis returns the underlying client
+func (c *RedisClient) Redis() redis.UniversalClient {
+	return c.client
+}
+
+func (c *RedisClient) Close() error {
+	return c.client.Close()
+}
+
+func (c *RedisClient) Set(ctx context.Context, key string, data interface{}) error {
+	return c.process(ctx, redis.NewStatusCmd("set", key, data))
+}
+
+func (c *RedisClient) Get(ctx context.Context, key string) ([]byte, error) {
+	cmd := redis.NewStringCmd("get", key)
+	if err := c.process(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd.Bytes()
+}
+
+func (c *RedisClient) HSet(ctx context.Context, hKey, key, data string) (bool, error) {
+	cmd := redis.NewBoolCmd("hset", hKey, key, data)
+	if err := c.process(ctx, cmd); err != nil {
+		return false, err
+	}
+
+	return cmd.Val(), nil
+}
+
+func (c *RedisClient) HGet(ctx context.Context, hKey, key string) (string, error) {
+	cmd := redis.NewStringCmd("hget", hKey, key)
+	if err := c.process(ctx, cmd); err != nil {
+		return "", err
+	}
+
+	return cmd.Val(), nil
+}
+
+func (c *RedisClient) HMGet(ctx context.Context, hKey string, keys ...string) ([]interface{}, error) {
+	args := make([]interface{}, 0, 2+len(keys))
+	args = append(args, "hmget", hKey)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	cmd := redis.NewSliceCmd(args...)
+	if err := c.process(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd.Val(), nil
+}
+
+func (c *RedisClient) HIncr(ctx context.Context, hKey, key string, num int64) error {
+	return c.process(ctx, redis.NewIntCmd("hincrby", hKey, key, num))
+}
+
+func (c *RedisClient) Hash(ctx context.Context, hKey string) (map[string]string, error) {
+	cmd := redis.NewStringStringMapCmd("hgetall", hKey)
+	if err := c.process(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	return cmd.Val(), nil
 }
 
 func RedisSet(key string, data interface{}) (err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	reply := client.Set(key, data, 0)
-	err = reply.Err()
-	return
+	return client.Set(context.Background(), key, data)
 }
 
 func RedisGet(key string) (reply *redis.StringCmd, err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	reply = client.Get(key)
-	err = reply.Err()
+	reply = redis.NewStringCmd("get", key)
+	err = client.process(context.Background(), reply)
 	return
 }
 
 func RedisHSet(hKey, key, data string) (success bool, err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	success, err = client.HSet(hKey, key, data).Result()
-	return
+	return client.HSet(context.Background(), hKey, key, data)
 }
 
 func RedisHGet(hKey, key string) (value string, err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	value, err = client.HGet(hKey, key).Result()
-	return
+	return client.HGet(context.Background(), hKey, key)
 }
 
 func RedisHMGet(hKey string, keys ...string) (values []interface{}, err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	values, err = client.HMGet(hKey, keys...).Result()
-	return
+	return client.HMGet(context.Background(), hKey, keys...)
 }
 
 func RedisHIncr(hKey, key string, num int64) (err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	reply := client.HIncrBy(hKey, key, num)
-	err = reply.Err()
-	return
+	return client.HIncr(context.Background(), hKey, key, num)
 }
 
 func RedisHash(hKey string) (hash map[string]string, err error) {
-	client := GetRedis()
+	client := DefaultRedis()
 	if client == nil {
-		err = errors.New("redis service unavailable")
+		err = ErrUnavailable
 		return
 	}
 
-	hash, err = client.HGetAllMap(hKey).Result()
-	return
+	return client.Hash(context.Background(), hKey)
 }
@@ -0,0 +1,381 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// the tests of this file run local redis-server processes, they are skipped
+// where redis-server is not installed
+
+// redis_process is a local redis-server
+type redis_process struct {
+	cmd    *exec.Cmd
+	port   int
+	client *redis.Client
+}
+
+func (p *redis_process) addr() string {
+	return "127.0.0.1:" + strconv.Itoa(p.port)
+}
+
+func (p *redis_process) stop() {
+	p.client.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// redis_dir skips the test without redis-server, else returns a directory
+// for the files of the servers
+func redis_dir(t *testing.T) string {
+	if _, err := exec.LookPath("redis-server"); err != nil {
+		t.Skip("redis-server not found")
+	}
+
+	dir, err := ioutil.TempDir("", "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// free_port returns a free port whose cluster bus port, 10000 above, is free too
+func free_port(t *testing.T) int {
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if port+10000 > 65535 {
+			continue
+		}
+
+		bus, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port+10000))
+		if err != nil {
+			continue
+		}
+		bus.Close()
+		return port
+	}
+
+	t.Fatal("no free port")
+	return 0
+}
+
+// run_redis starts redis-server with args and waits for it to answer
+func run_redis(t *testing.T, port int, args ...string) *redis_process {
+	p := &redis_process{cmd: exec.Command("redis-server", args...), port: port}
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.client = redis.NewClient(&redis.Options{Addr: p.addr()})
+
+	started := false
+	defer func() {
+		if !started {
+			p.stop()
+		}
+	}()
+	wait_for(t, "redis-server "+p.addr(), func() bool {
+		return p.client.Ping().Err() == nil
+	})
+	started = true
+	return p
+}
+
+// start_redis starts a server keeping its files in a directory of dir
+func start_redis(t *testing.T, dir string, args ...string) *redis_process {
+	port := free_port(t)
+	dir = filepath.Join(dir, strconv.Itoa(port))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	args = append([]string{
+		"--port", strconv.Itoa(port),
+		"--bind", "127.0.0.1",
+		"--dir", dir,
+		"--save", "",
+		"--appendonly", "no",
+	}, args...)
+
+	return run_redis(t, port, args...)
+}
+
+// start_sentinel starts a sentinel monitoring master as the group "master"
+func start_sentinel(t *testing.T, dir string, master *redis_process) *redis_process {
+	port := free_port(t)
+	conf := filepath.Join(dir, fmt.Sprintf("sentinel-%v.conf", port))
+	lines := []string{
+		fmt.Sprintf("port %v", port),
+		"bind 127.0.0.1",
+		"dir " + dir,
+		fmt.Sprintf("sentinel monitor master 127.0.0.1 %v 1", master.port),
+		"sentinel down-after-milliseconds master 1000",
+		"sentinel failover-timeout master 5000",
+	}
+	if err := ioutil.WriteFile(conf, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return run_redis(t, port, conf, "--sentinel")
+}
+
+// wait_for polls cond for up to 30s
+func wait_for(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRedisServerStandalone(t *testing.T) {
+	dir := redis_dir(t)
+	defer os.RemoveAll(dir)
+
+	server := start_redis(t, dir)
+	defer server.stop()
+
+	c, err := NewRedisClient(context.Background(), RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{server.addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("get %s err %v", value, err)
+	}
+	if _, err := c.Get(ctx, "missing"); err != ErrNil {
+		t.Fatalf("get missing err %v", err)
+	}
+
+	if err := c.FencedSet(ctx, "fenced", 2, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// the script is sent again once the server forgot it
+	if err := server.client.ScriptFlush().Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FencedSet(ctx, "fenced", 1, "b"); err != ErrStaleToken {
+		t.Fatalf("stale err %v", err)
+	}
+	if err := c.FencedSet(ctx, "fenced", 3, "c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisServerSentinel(t *testing.T) {
+	dir := redis_dir(t)
+	defer os.RemoveAll(dir)
+
+	master := start_redis(t, dir)
+	defer master.stop()
+	replica := start_redis(t, dir, "--slaveof", "127.0.0.1", strconv.Itoa(master.port))
+	defer replica.stop()
+	wait_for(t, "replication", func() bool {
+		info, _ := replica.client.Info("replication").Result()
+		return strings.Contains(info, "master_link_status:up")
+	})
+
+	sentinel := start_sentinel(t, dir, master)
+	defer sentinel.stop()
+	sentinel_client := redis.NewSentinelClient(&redis.Options{Addr: sentinel.addr()})
+	defer sentinel_client.Close()
+
+	c, err := NewRedisClient(context.Background(), RedisConfig{
+		Mode:       REDIS_SENTINEL,
+		Addrs:      []string{sentinel.addr()},
+		MasterName: "master",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.Set(ctx, "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := master.client.Get("key").Result(); err != nil || value != "a" {
+		t.Fatalf("master has %v err %v", value, err)
+	}
+
+	// the replica is promoted, the client follows the new master
+	wait_for(t, "failover", func() bool {
+		return sentinel_client.Failover("master").Err() == nil
+	})
+	wait_for(t, "promotion", func() bool {
+		addr, err := sentinel_client.GetMasterAddrByName("master").Result()
+		return err == nil && len(addr) == 2 && addr[1] == strconv.Itoa(replica.port)
+	})
+	wait_for(t, "write to the new master", func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := c.Set(ctx, "key", "b"); err != nil {
+			return false
+		}
+		value, _ := replica.client.Get("key").Result()
+		return value == "b"
+	})
+	if value, err := c.Get(ctx, "key"); err != nil || string(value) != "b" {
+		t.Fatalf("get %s err %v", value, err)
+	}
+}
+
+func TestRedisServerCluster(t *testing.T) {
+	dir := redis_dir(t)
+	defer os.RemoveAll(dir)
+
+	slots := [][2]int{{0, 5460}, {5461, 10922}, {10923, 16383}}
+	nodes := make([]*redis_process, len(slots))
+	ids := make([]string, len(slots))
+	for i := range nodes {
+		nodes[i] = start_redis(t, dir,
+			"--cluster-enabled", "yes",
+			"--cluster-config-file", "nodes.conf",
+			"--cluster-node-timeout", "5000",
+		)
+		defer nodes[i].stop()
+
+		id, err := nodes[i].client.Do("cluster", "myid").Text()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+
+		if err := nodes[i].client.ClusterAddSlotsRange(slots[i][0], slots[i][1]).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err := nodes[0].client.ClusterMeet("127.0.0.1", strconv.Itoa(nodes[i].port)).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wait_for(t, "cluster", func() bool {
+		for _, node := range nodes {
+			info, _ := node.client.ClusterInfo().Result()
+			if !strings.Contains(info, "cluster_state:ok") || !strings.Contains(info, "cluster_known_nodes:3") {
+				return false
+			}
+		}
+		return true
+	})
+
+	owner := func(slot int) int {
+		for i, r := range slots {
+			if slot >= r[0] && slot <= r[1] {
+				return i
+			}
+		}
+		return -1
+	}
+	slot_of := func(key string) int {
+		slot, err := nodes[0].client.ClusterKeySlot(key).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(slot)
+	}
+	setslot := func(node *redis_process, args ...interface{}) {
+		if err := node.client.Do(append([]interface{}{"cluster", "setslot"}, args...)...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the client learns the slots from the seed node
+	c, err := NewRedisClient(context.Background(), RedisConfig{Mode: REDIS_CLUSTER, Addrs: []string{nodes[0].addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		if err := c.Set(ctx, key, i); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := nodes[owner(slot_of(key))].client.Get(key).Int(); err != nil || value != i {
+			t.Fatalf("%v is %v err %v", key, value, err)
+		}
+	}
+	if err := c.FencedSet(ctx, "fenced", 2, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FencedSet(ctx, "fenced", 1, "b"); err != ErrStaleToken {
+		t.Fatalf("stale err %v", err)
+	}
+
+	// MOVED: the slot of key changes owner after the client loaded the slots
+	moved := "moved"
+	slot := slot_of(moved)
+	dst := (owner(slot) + 1) % len(nodes)
+	for _, node := range nodes {
+		setslot(node, slot, "node", ids[dst])
+	}
+	if err := c.Set(ctx, moved, "v"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := nodes[dst].client.Get(moved).Result(); err != nil || value != "v" {
+		t.Fatalf("moved key on %v is %v err %v", nodes[dst].addr(), value, err)
+	}
+	if value, err := c.Get(ctx, moved); err != nil || string(value) != "v" {
+		t.Fatalf("get moved %s err %v", value, err)
+	}
+
+	// ASK: the slot of key is being migrated, the keys already moved and the
+	// new keys are on the importing node
+	old, fresh := "{ask}old", "{ask}new"
+	slot = slot_of(old)
+	if slot == slot_of(moved) {
+		t.Fatal("the keys share a slot")
+	}
+	src := owner(slot)
+	dst = (src + 1) % len(nodes)
+	if err := c.Set(ctx, old, "a"); err != nil {
+		t.Fatal(err)
+	}
+	setslot(nodes[dst], slot, "importing", ids[src])
+	setslot(nodes[src], slot, "migrating", ids[dst])
+	if err := nodes[src].client.Do("migrate", "127.0.0.1", nodes[dst].port, old, 0, 5000).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := c.Get(ctx, old); err != nil || string(value) != "a" {
+		t.Fatalf("get migrated %s err %v", value, err)
+	}
+	if err := c.Set(ctx, fresh, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes {
+		setslot(node, slot, "node", ids[dst])
+	}
+	for key, want := range map[string]string{old: "a", fresh: "b"} {
+		if value, err := nodes[dst].client.Get(key).Result(); err != nil || value != want {
+			t.Fatalf("%v on %v is %v err %v", key, nodes[dst].addr(), value, err)
+		}
+	}
+}
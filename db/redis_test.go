@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v7"
+	"github.com/golang/protobuf/proto"
+)
+
+// user_data is UserData of test.proto
+type user_data struct {
+	Id               *int32  `protobuf:"varint,1,req,name=id" json:"id,omitempty"`
+	Name             *string `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Level            *int32  `protobuf:"varint,4,opt,name=level" json:"level,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *user_data) Reset()         { *m = user_data{} }
+func (m *user_data) String() string { return proto.CompactTextString(m) }
+func (*user_data) ProtoMessage()    {}
+
+// sentinel fakes a sentinel monitoring the master m
+func sentinel(t *testing.T, m *miniredis.Miniredis) *server.Server {
+	s, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		switch strings.ToLower(args[0]) {
+		case "get-master-addr-by-name":
+			c.WriteLen(2)
+			c.WriteBulk(m.Host())
+			c.WriteBulk(m.Port())
+		default:
+			c.WriteLen(0)
+		}
+	})
+	s.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(3)
+		c.WriteBulk("subscribe")
+		c.WriteBulk(args[0])
+		c.WriteInt(1)
+	})
+	s.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+
+	return s
+}
+
+func TestRedisModes(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	s := sentinel(t, m)
+	defer s.Close()
+
+	configs := []RedisConfig{
+		{Mode: REDIS_STANDALONE, Addrs: []string{m.Addr()}},
+		{Mode: REDIS_SENTINEL, Addrs: []string{s.Addr().String()}, MasterName: "master"},
+		// miniredis answers CLUSTER SLOTS with itself holding every slot
+		{Mode: REDIS_CLUSTER, Addrs: []string{m.Addr()}},
+	}
+
+	for _, cfg := range configs {
+		t.Run(cfg.Mode, func(t *testing.T) {
+			m.FlushAll()
+			if err := InitRedisConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+			defer DefaultRedis().Close()
+
+			if err := RedisSet("key", "value"); err != nil {
+				t.Fatal(err)
+			}
+			if reply, err := RedisGet("key"); err != nil || reply.Val() != "value" {
+				t.Fatalf("get %v err %v", reply, err)
+			}
+			if _, err := RedisGet("missing"); err != ErrNil || !IsNilReply(err) {
+				t.Fatalf("get missing err %v", err)
+			}
+
+			if err := RedisHIncr("hash", "count", 2); err != nil {
+				t.Fatal(err)
+			}
+			if success, err := RedisHSet("hash", "field", "v"); err != nil || !success {
+				t.Fatalf("hset %v err %v", success, err)
+			}
+			values, err := RedisHMGet("hash", "count", "field", "missing")
+			if err != nil || values[0] != "2" || values[1] != "v" || values[2] != nil {
+				t.Fatalf("hmget %v err %v", values, err)
+			}
+			if hash, err := RedisHash("hash"); err != nil || len(hash) != 2 {
+				t.Fatalf("hash %v err %v", hash, err)
+			}
+
+			// the proto helpers
+			user := &user_data{Id: proto.Int32(1), Name: proto.String("name"), Level: proto.Int32(3)}
+			var bytes ProtoByte
+			bytes.Bind(user, "user:1")
+			if err := bytes.Save(); err != nil {
+				t.Fatal(err)
+			}
+			loaded := &user_data{}
+			bytes.Bind(loaded, "user:1")
+			if err := bytes.Load(); err != nil || *loaded.Level != 3 {
+				t.Fatalf("load %v err %v", loaded, err)
+			}
+
+			var hash ProtoHash
+			hash.Bind(user, "user:2")
+			if err, desc := hash.Save(); err != nil || desc != "" {
+				t.Fatalf("save err %v %v", err, desc)
+			}
+			loaded = &user_data{}
+			hash.Bind(loaded, "user:2")
+			if err, desc := hash.Load(); err != nil || desc != "" || loaded.Name == nil || *loaded.Name != "name" {
+				t.Fatalf("load %v err %v %v", loaded, err, desc)
+			}
+			if err := hash.LoadFields("Id", "Level"); err != nil || *loaded.Id != 1 {
+				t.Fatalf("load fields %v err %v", loaded, err)
+			}
+
+			// fenced writes run a script
+			if err := RedisFencedSet("fenced", 2, "a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := RedisFencedSet("fenced", 1, "b"); err != ErrStaleToken {
+				t.Fatalf("stale err %v", err)
+			}
+		})
+	}
+}
+
+func TestRedisContext(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	c, err := NewRedisClient(context.Background(), RedisConfig{Addrs: []string{m.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Set(context.Background(), "n", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.Get(ctx, "n"); err != context.Canceled {
+		t.Fatalf("get err %v", err)
+	}
+	if err := c.FencedSet(ctx, "fenced", 1, "a"); err != context.Canceled {
+		t.Fatalf("fenced set err %v", err)
+	}
+	if err := c.FencedHSet(context.Background(), "hash", "field", 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FencedHSet(context.Background(), "hash", "field", 0, "b"); err != ErrStaleToken {
+		t.Fatalf("stale err %v", err)
+	}
+
+	// the deadline bounds a call to a server not answering
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = NewRedisClient(ctx, RedisConfig{Mode: REDIS_STANDALONE, Addrs: []string{l.Addr().String()}})
+	if err == nil || time.Since(start) > time.Second {
+		t.Fatalf("err %v after %v", err, time.Since(start))
+	}
+
+	// and a fenced write
+	silent := &RedisClient{client: redis.NewClient(&redis.Options{Addr: l.Addr().String()})}
+	defer silent.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := silent.FencedSet(ctx, "fenced", 1, "a"); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("fenced set err %v after %v", err, time.Since(start))
+	}
+}
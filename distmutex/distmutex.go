@@ -2,16 +2,22 @@ package distmutex
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"sync"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/etcd-io/etcd/clientv3/concurrency"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	LEASE_TIMEOUT = 5
+	LEASE_TIMEOUT = 5 // default lease ttl of the lock holders in seconds
+)
+
+var (
+	ErrLockLost = errors.New("distmutex lock lost")
 )
 
 var (
@@ -19,20 +25,48 @@ var (
 	_default_server server
 )
 
-func Init(prefix string, etcd_hosts []string) {
+func Init(prefix string, etcd_hosts []string, opts ...Option) {
 	once.Do(func() {
-		_default_server.init(prefix, etcd_hosts)
+		_default_server.init(prefix, etcd_hosts, opts...)
 	})
 }
 
 type server struct {
-	prefix string
-	client *clientv3.Client
-	mu     sync.RWMutex
+	prefix   string
+	client   *clientv3.Client
+	ttl      int                  // lease ttl of the lock holders in seconds
+	session  *concurrency.Session // lease shared by the lock holders
+	seq      uint64               // tells apart the holders sharing the session
+	identity Identity             // of the holders of the process
+	statter  Statter
+	mu       sync.RWMutex
+	local    map[string]*local_queue // by prefix/key/ of the Mutex locks
+	local_mu sync.Mutex
 }
 
-func (p *server) init(prefix string, hosts []string) {
+// Option configures the locks
+type Option func(*server)
+
+// WithTTL sets the lease ttl of the lock holders, LEASE_TIMEOUT seconds by
+// default. The lease is kept alive until Close, a process that stops
+// refreshing it loses its locks after ttl.
+func WithTTL(ttl time.Duration) Option {
+	return func(p *server) {
+		p.ttl = int((ttl + time.Second - 1) / time.Second)
+		if p.ttl < 1 {
+			p.ttl = 1
+		}
+	}
+}
+
+func (p *server) init(prefix string, hosts []string, opts ...Option) {
 	p.prefix = prefix
+	p.ttl = LEASE_TIMEOUT
+	p.identity = local_identity()
+	p.statter = noop_statter{}
+	for _, opt := range opts {
+		opt(p)
+	}
 
 	cfg := clientv3.Config{
 		Endpoints: hosts,
@@ -50,50 +84,152 @@ func (p *server) init(prefix string, hosts []string) {
 func (p *server) watcher() {
 	watcher := clientv3.NewWatcher(p.client)
 	channel := watcher.Watch(context.Background(), p.prefix, clientv3.WithPrefix())
-	for {
-		select {
-		case change := <-channel:
-			for _, ev := range change.Events {
+	for change := range channel {
+		for _, ev := range change.Events {
+			id, ok := parse_identity(ev.Kv)
+			switch {
+			case ev.Type == mvccpb.DELETE:
+				log.Infof("locks change: %s released", string(ev.Kv.Key))
+			case !ok:
 				log.Infof("locks change: %s, %v", string(ev.Kv.Key), ev.Type)
+			case id.Acquired.IsZero():
+				log.Infof("locks change: %v queued by %v", id.Lock, id)
+			default:
+				log.Infof("locks change: %v acquired by %v after %v", id.Lock, id, id.Acquired.Sub(id.Queued))
 			}
 		}
 	}
 }
 
-func (p *server) lockDo(key string, f func()) error {
-	if p.client == nil {
-		return fmt.Errorf("locks connection err")
+// timeout bounds the requests releasing a lock, past the ttl the lease
+// releases it anyway
+func (p *server) timeout() time.Duration {
+	return time.Duration(p.ttl) * time.Second
+}
+
+// get_session returns the session shared by the lock holders of the process,
+// one round trip less per lock than a session of their own, a new session
+// replaces the previous one once its lease is lost. The lease is granted
+// within ctx and without holding p.mu, so a caller is not held up by etcd
+// being unreachable past its deadline, nor by other callers.
+func (p *server) get_session(ctx context.Context) (*concurrency.Session, error) {
+	if session := p.live_session(); session != nil {
+		return session, nil
 	}
 
-	res, err := p.client.Grant(context.Background(), LEASE_TIMEOUT)
+	session, err := new_session(ctx, p.client, p.ttl)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// another caller renewed it meanwhile
+	if p.session != nil {
+		select {
+		case <-p.session.Done():
+		default:
+			go session.Close()
+			return p.session, nil
+		}
+	}
+
+	p.session = session
+	go p.watch_session(session)
+	return session, nil
+}
+
+// live_session returns the shared session unless its lease is lost
+func (p *server) live_session() *concurrency.Session {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.session == nil {
+		return nil
+	}
+
+	select {
+	case <-p.session.Done():
+		return nil
+	default:
+		return p.session
 	}
+}
 
-	session, err := concurrency.NewSession(p.client, concurrency.WithLease(res.ID))
+// new_session grants a lease of ttl seconds within ctx and keeps it alive,
+// concurrency.NewSession would grant it waiting for etcd regardless of ctx
+func new_session(ctx context.Context, client *clientv3.Client, ttl int) (*concurrency.Session, error) {
+	resp, err := client.Grant(ctx, int64(ttl))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	mux := concurrency.NewMutex(session, p.prefix+"/"+key)
-	if err := mux.Lock(context.Background()); err != nil {
-		return err
+	// the ttl bounds the revoke of Close
+	session, err := concurrency.NewSession(client, concurrency.WithLease(resp.ID), concurrency.WithTTL(ttl))
+	if err != nil {
+		revoke_ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ttl)*time.Second)
+		defer cancel()
+		client.Revoke(revoke_ctx, resp.ID)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// watch_session counts the loss of the lease of session, unless it was closed
+func (p *server) watch_session(session *concurrency.Session) {
+	<-session.Done()
+
+	p.mu.RLock()
+	lost := p.session == session
+	p.mu.RUnlock()
+	if lost {
+		log.Warnf("distmutex lease %x lost", session.Lease())
+		p.statter.Counter(1.0, "distmutex.lease_lost", 1)
 	}
+}
 
-	session.Orphan()
+// close revokes the shared lease, which releases the locks still held, and
+// closes the connection
+func (p *server) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	//ttl, _ := p.client.TimeToLive(context.TODO(), res.ID)
-	//log.Infof("lease ttl = %v", ttl.TTL)
+	if p.session != nil {
+		p.session.Close()
+		p.session = nil
+	}
 
-	f()
+	if p.client == nil {
+		return nil
+	}
 
-	if err := mux.Unlock(context.TODO()); err != nil {
+	return p.client.Close()
+}
+
+// lockDo runs f under the lock of key, see hold
+func (p *server) lockDo(ctx context.Context, key string, f func(context.Context)) error {
+	mux := p.new_mutex(key)
+	if err := mux.Lock(ctx); err != nil {
 		return err
 	}
 
-	return nil
+	return hold(ctx, mux.Done(), mux.Token(), mux.Unlock, p.timeout(), f)
+}
+
+// Close releases the locks still held by the process and closes the
+// connection to etcd, call it on shutdown
+func Close() error {
+	return _default_server.close()
 }
 
+// DistMutexLockDo runs f under the lock of key, waiting as long as it takes,
+// see LockDo to bound the wait and get the error. It is not reentrant, nested
+// calls on one key should use LockDo with a ctx of WithOwner.
 func DistMutexLockDo(key string, f func()) {
-	_default_server.lockDo(key, f)
+	err := _default_server.lockDo(context.Background(), key, func(context.Context) { f() })
+	if err != nil {
+		log.Errorf("distmutex lock %v err %v", key, err)
+	}
 }
@@ -1,17 +1,57 @@
 package distmutex
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/etcd-io/etcd/clientv3/concurrency"
+	"github.com/go-redis/redis/v7"
 	log "github.com/sirupsen/logrus"
 	//"github.com/xymodule/libs/distmutex"
 )
 
-var endpoints []string = []string{"http://172.16.10.222:2379", "http://172.16.10.223:2379", "http://172.16.10.224:2379"}
+var endpoints []string = []string{"http://127.0.0.1:23792"}
+
+// an embedded etcd, so the tests need no external cluster
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "distmutex")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	client_url, _ := url.Parse(endpoints[0])
+	peer_url, _ := url.Parse("http://127.0.0.1:23802")
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*client_url}, []url.URL{*client_url}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peer_url}, []url.URL{*peer_url}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	<-etcd.Server.ReadyNotify()
 
-func init() {
 	Init("/backends", endpoints)
+	code := m.Run()
+
+	etcd.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestDistMutex(t *testing.T) {
@@ -20,6 +60,965 @@ func TestDistMutex(t *testing.T) {
 	})
 }
 
+// other_server is another process on the locks of the default server, its
+// handles meet those of the default server in etcd rather than in the
+// local queue
+func other_server() *server {
+	p := &server{}
+	p.init("/backends", endpoints, WithServiceID("other"))
+	return p
+}
+
+func TestMutex(t *testing.T) {
+	other := other_server()
+	defer other.close()
+
+	m1, m2 := NewMutex("mutex"), other.new_mutex("mutex")
+	if err := m1.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.TryLock(context.Background()); err != ErrLocked {
+		t.Fatalf("trylock err %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m2.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("lock err %v", err)
+	}
+
+	// the failed attempts left the line
+	info, err := Inspect(context.Background(), "mutex")
+	if err != nil || len(info.Holders) != 1 || len(info.Waiters) != 0 || info.Holders[0].Token != m1.Token() {
+		t.Fatalf("inspect %+v err %v", info, err)
+	}
+
+	// the waiter gets the lock once the holder unlocks
+	locked := make(chan error)
+	go func() { locked <- m2.Lock(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	if err := m1.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Unlock(context.Background()); err != ErrNotLocked {
+		t.Fatalf("unlock err %v", err)
+	}
+	if err := m1.TryLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m1.Unlock(context.Background())
+}
+
+func TestFencingToken(t *testing.T) {
+	var last int64
+	for i := 0; i < 3; i++ {
+		err := LockDo(context.Background(), "fence", func(ctx context.Context) {
+			token, ok := FencingToken(ctx)
+			if !ok || token <= last {
+				t.Fatalf("token %v after %v", token, last)
+			}
+			last = token
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMutex("fence")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unlock(context.Background())
+	if m.Token() <= last {
+		t.Fatalf("token %v after %v", m.Token(), last)
+	}
+}
+
+func TestLockDo(t *testing.T) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inside, count := 0, 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := LockDo(context.Background(), "lockdo", func(context.Context) {
+				mu.Lock()
+				inside++
+				if inside > 1 {
+					t.Error("two holders")
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inside--
+				count++
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count != 5 {
+		t.Fatalf("ran %v times", count)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	c, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the lease expires as in a partition, f is told and LockDo reports it
+	err = LockDo(context.Background(), "lost", func(ctx context.Context) {
+		resp, err := c.Get(ctx, "/backends/lost/", clientv3.WithPrefix())
+		if err != nil || len(resp.Kvs) != 1 {
+			t.Fatalf("lock keys %v err %v", resp, err)
+		}
+		if _, err := c.Revoke(ctx, clientv3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(3 * LEASE_TIMEOUT * time.Second):
+			t.Fatal("lock loss not noticed")
+		}
+	})
+	if err != ErrLockLost {
+		t.Fatalf("lockdo err %v", err)
+	}
+
+	// the lease is kept alive past its ttl while the lock is held
+	m := NewMutex("kept")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-m.Done():
+		t.Fatal("lock lost")
+	case <-time.After((LEASE_TIMEOUT + 1) * time.Second):
+	}
+	if err := m.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// proxy forwards to etcd until drop, which cuts the connections and refuses
+// new ones as in a partition
+type proxy struct {
+	listener net.Listener
+	conns    []net.Conn
+	mu       sync.Mutex
+}
+
+func new_proxy(t *testing.T, target string) *proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &proxy{listener: l}
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", target)
+			if err != nil {
+				in.Close()
+				continue
+			}
+
+			p.mu.Lock()
+			p.conns = append(p.conns, in, out)
+			p.mu.Unlock()
+			go io.Copy(in, out)
+			go io.Copy(out, in)
+		}
+	}()
+
+	return p
+}
+
+func (p *proxy) drop() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func TestLockLostPartition(t *testing.T) {
+	client_url, _ := url.Parse(endpoints[0])
+	pr := new_proxy(t, client_url.Host)
+	p := &server{}
+	p.init("/partition", []string{"http://" + pr.listener.Addr().String()}, WithTTL(time.Second))
+	defer p.close()
+
+	// the release of the lost lock does not wait for etcd
+	result := make(chan error, 1)
+	go func() {
+		result <- p.lockDo(context.Background(), "partitioned", func(ctx context.Context) {
+			pr.drop()
+			<-ctx.Done()
+		})
+	}()
+
+	select {
+	case err := <-result:
+		if err != ErrLockLost {
+			t.Fatalf("lockdo err %v", err)
+		}
+	case <-time.After(5 * LEASE_TIMEOUT * time.Second):
+		t.Fatal("lockdo blocked by the partition")
+	}
+}
+
+func TestRWMutex(t *testing.T) {
+	r1, r2, w := NewRWMutex("rw"), NewRWMutex("rw"), NewRWMutex("rw")
+	if err := r1.RLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r2.RLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan error)
+	go func() { locked <- w.Lock(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// a reader arriving after the waiting writer waits behind it
+	r3 := NewRWMutex("rw")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := r3.RLock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("rlock err %v", err)
+	}
+
+	r1.RUnlock(context.Background())
+	select {
+	case <-locked:
+		t.Fatal("writer along with a reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	r2.RUnlock(context.Background())
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+
+	rlocked := make(chan error)
+	go func() { rlocked <- r3.RLock(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	w.Unlock(context.Background())
+	if err := <-rlocked; err != nil {
+		t.Fatal(err)
+	}
+	r3.RUnlock(context.Background())
+}
+
+func TestSemaphore(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if _, err := NewSemaphore("sem", n); err == nil {
+			t.Fatalf("semaphore of %v", n)
+		}
+		if err := SemaphoreDo(context.Background(), "sem", n, func(ctx context.Context) {}); err == nil {
+			t.Fatalf("semaphoredo of %v", n)
+		}
+	}
+
+	var s [3]*Semaphore
+	for i := range s {
+		var err error
+		if s[i], err = NewSemaphore("sem", 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s1, s2, s3 := s[0], s[1], s[2]
+	if err := s1.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.TryAcquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.TryAcquire(context.Background()); err != ErrLocked {
+		t.Fatalf("tryacquire err %v", err)
+	}
+
+	acquired := make(chan error)
+	go func() { acquired <- s3.Acquire(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	s1.Release(context.Background())
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	s2.Release(context.Background())
+	s3.Release(context.Background())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inside, max := 0, 0
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := SemaphoreDo(context.Background(), "semdo", 3, func(context.Context) {
+				mu.Lock()
+				inside++
+				if inside > max {
+					max = inside
+				}
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				inside--
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max > 3 {
+		t.Fatalf("%v holders", max)
+	}
+}
+
+func TestElection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leaders := Observe(ctx, "election")
+	if leader := <-leaders; leader != "" {
+		t.Fatalf("leader %v", leader)
+	}
+	if _, err := Leader(ctx, "election"); err != ErrNoLeader {
+		t.Fatalf("leader err %v", err)
+	}
+
+	a, err := Campaign(ctx, "election", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader := <-leaders; leader != "a" {
+		t.Fatalf("leader %v", leader)
+	}
+
+	elected := make(chan *Leadership)
+	go func() {
+		b, err := Campaign(ctx, "election", "b")
+		if err != nil {
+			t.Error(err)
+		}
+		elected <- b
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("two leaders")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := a.Resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b := <-elected
+	if leader := <-leaders; leader != "b" {
+		t.Fatalf("leader %v", leader)
+	}
+	if b.Token() <= 0 {
+		t.Fatalf("token %v", b.Token())
+	}
+	select {
+	case <-b.Done():
+		t.Fatal("leadership lost")
+	default:
+	}
+
+	b.Resign(ctx)
+	<-b.Done()
+	if leader := <-leaders; leader != "" {
+		t.Fatalf("leader %v", leader)
+	}
+}
+
+func TestNotInitialized(t *testing.T) {
+	p := &server{}
+	if _, err := p.campaign(context.Background(), "election", "candidate"); err == nil {
+		t.Fatal("campaign without connection")
+	}
+	if _, err := p.leader(context.Background(), "election"); err == nil {
+		t.Fatal("leader without connection")
+	}
+	out := make(chan string)
+	go p.observe(context.Background(), "election/", out)
+	if leader, ok := <-out; ok {
+		t.Fatalf("observed %v without connection", leader)
+	}
+	if _, err := p.inspect(context.Background(), "lock"); err == nil {
+		t.Fatal("inspect without connection")
+	}
+}
+
+func TestDeadEndpoint(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	p := &server{}
+	p.init("/dead", []string{l.Addr().String()})
+	defer p.close()
+
+	// the wait for etcd is bounded by ctx
+	m := p.new_mutex("dead")
+	for name, f := range map[string]func(ctx context.Context) error{
+		"trylock": m.TryLock,
+		"lock":    m.Lock,
+		"campaign": func(ctx context.Context) error {
+			_, err := p.campaign(ctx, "election", "candidate")
+			return err
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		start := time.Now()
+		err := f(ctx)
+		cancel()
+		if err != context.DeadlineExceeded || time.Since(start) > 2*time.Second {
+			t.Fatalf("%v err %v after %v", name, err, time.Since(start))
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	m1, m2 := NewMutex("shared1"), NewMutex("shared2")
+	if err := m1.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m1.session != m2.session {
+		t.Fatal("session not shared")
+	}
+
+	// handles of one process on one key still exclude each other, and those
+	// of another process
+	m3 := NewMutex("shared1")
+	if err := m3.TryLock(context.Background()); err != ErrLocked {
+		t.Fatalf("trylock err %v", err)
+	}
+	other := other_server()
+	defer other.close()
+	if err := other.new_mutex("shared1").TryLock(context.Background()); err != ErrLocked {
+		t.Fatalf("other trylock err %v", err)
+	}
+
+	session := m1.session
+	m1.Unlock(context.Background())
+	m2.Unlock(context.Background())
+	select {
+	case <-session.Done():
+		t.Fatal("session closed on unlock")
+	default:
+	}
+
+	// a closed server releases its locks
+	p := &server{}
+	p.init("/closing", endpoints)
+	m := p.new_mutex("closed")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	key := m.Key()
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Get(context.Background(), key)
+	if err != nil || len(resp.Kvs) != 0 {
+		t.Fatalf("%v left after close, err %v", key, err)
+	}
+}
+
+func TestReentrant(t *testing.T) {
+	other := other_server()
+	defer other.close()
+
+	ctx, cancel := context.WithTimeout(WithOwner(context.Background()), 5*time.Second)
+	defer cancel()
+
+	err := LockDo(ctx, "reentrant", func(ctx context.Context) {
+		outer, _ := FencingToken(ctx)
+		err := LockDo(ctx, "reentrant", func(ctx context.Context) {
+			if inner, _ := FencingToken(ctx); inner != outer {
+				t.Fatalf("token %v in %v", inner, outer)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// held until the outer unlock, against other owners and processes
+		if err := NewMutex("reentrant").TryLock(WithOwner(context.Background())); err != ErrLocked {
+			t.Fatalf("trylock err %v", err)
+		}
+		if err := other.new_mutex("reentrant").TryLock(WithOwner(context.Background())); err != ErrLocked {
+			t.Fatalf("other trylock err %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMutex("reentrant")
+	if err := m.TryLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.Unlock(context.Background())
+}
+
+func TestLocalQueue(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := LockDo(context.Background(), "local", func(ctx context.Context) {
+				// the other goroutines do not queue in etcd
+				info, err := Inspect(ctx, "local")
+				if err != nil || len(info.Holders) != 1 || len(info.Waiters) != 0 {
+					t.Errorf("inspect %+v err %v", info, err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(_default_server.local) != 0 {
+		t.Fatalf("local queues left %v", _default_server.local)
+	}
+}
+
+func TestOnce(t *testing.T) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	runs := 0
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := Once(context.Background(), "migrate", func(ctx context.Context) (string, error) {
+				mu.Lock()
+				runs++
+				mu.Unlock()
+				return "migrated", nil
+			})
+			if err != nil || c.Result != "migrated" {
+				t.Errorf("once %+v err %v", c, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if runs != 1 {
+		t.Fatalf("%v runs", runs)
+	}
+
+	// a failed run is tried again
+	failed := errors.New("failed")
+	_, err := Once(context.Background(), "retried", func(ctx context.Context) (string, error) {
+		return "", failed
+	})
+	if err != failed {
+		t.Fatalf("once err %v", err)
+	}
+	c, err := Once(context.Background(), "retried", func(ctx context.Context) (string, error) {
+		return "ok", nil
+	})
+	if err != nil || c.Result != "ok" || c.Holder.PID != os.Getpid() {
+		t.Fatalf("once %+v err %v", c, err)
+	}
+}
+
+func TestOncePer(t *testing.T) {
+	runs := 0
+	job := func(ctx context.Context) (string, error) {
+		runs++
+		return fmt.Sprint(runs), nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := OncePer(context.Background(), "hourly", time.Hour, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("%v runs", runs)
+	}
+
+	// a run of the previous period
+	c, _ := json.Marshal(Completion{At: time.Now().Add(-time.Hour)})
+	if _, err := _default_server.client.Put(context.Background(), "/backends/hourly"+ONCE_SUFFIX, string(c)); err != nil {
+		t.Fatal(err)
+	}
+	completion, err := OncePer(context.Background(), "hourly", time.Hour, job)
+	if err != nil || runs != 2 || completion.Result != "2" {
+		t.Fatalf("%v runs, once %+v err %v", runs, completion, err)
+	}
+}
+
+type record_statter struct {
+	counters map[string]int
+	timings  map[string]int
+	mu       sync.Mutex
+}
+
+func (s *record_statter) Counter(sampleRate float32, bucket string, n ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[bucket] += n[0]
+}
+
+func (s *record_statter) Timing(sampleRate float32, bucket string, d ...time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timings[bucket]++
+}
+
+func TestInspect(t *testing.T) {
+	statter := &record_statter{counters: make(map[string]int), timings: make(map[string]int)}
+	p := &server{}
+	p.init("/inspect", endpoints, WithServiceID("inspector"), WithStatter(statter))
+	defer p.close()
+	other := &server{}
+	other.init("/inspect", endpoints, WithServiceID("other"))
+	defer other.close()
+
+	// the goroutines of a process wait in the process, another process in etcd
+	m1, m2 := p.new_mutex("jobs/a"), other.new_mutex("jobs/a")
+	if err := m1.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.new_mutex("jobs/a").TryLock(context.Background()); err != ErrLocked {
+		t.Fatalf("trylock err %v", err)
+	}
+	locked := make(chan error)
+	go func() { locked <- m2.Lock(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	info, err := p.inspect(context.Background(), "jobs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Holders) != 1 || len(info.Waiters) != 1 || info.Waiters[0].Service != "other" {
+		t.Fatalf("inspect %+v", info)
+	}
+	holder := info.Holders[0]
+	if holder.Service != "inspector" || holder.PID != os.Getpid() || holder.Token != m1.Token() || holder.Acquired.IsZero() {
+		t.Fatalf("holder %+v", holder)
+	}
+
+	s, err := p.new_semaphore("jobs/b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := p.list(context.Background(), "jobs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Key != "jobs/a" || infos[1].Key != "jobs/b" || len(infos[1].Holders) != 1 {
+		t.Fatalf("list %+v", infos)
+	}
+	s.Release(context.Background())
+
+	// the waiter writes its acquisition
+	m1.Unlock(context.Background())
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	info, err = p.inspect(context.Background(), "jobs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Holders) != 1 || len(info.Waiters) != 0 || info.Holders[0].Token != m2.Token() ||
+		!info.Holders[0].Acquired.After(info.Holders[0].Queued) {
+		t.Fatalf("inspect %+v", info)
+	}
+	m2.Unlock(context.Background())
+
+	statter.mu.Lock()
+	defer statter.mu.Unlock()
+	if statter.counters["distmutex.contention"] != 1 || statter.timings["distmutex.wait"] != 2 || statter.timings["distmutex.hold"] != 2 {
+		t.Fatalf("metrics %v %v", statter.counters, statter.timings)
+	}
+
+	// the holder of a redis lock
+	locks, r := redis_locks(t, 0)
+	defer r.Close()
+	m := locks.NewMutex("jobs/a")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	info, err = locks.Inspect(context.Background(), "jobs/a")
+	if err != nil || len(info.Holders) != 1 || info.Holders[0].Lock != "jobs/a" {
+		t.Fatalf("redis inspect %+v err %v", info, err)
+	}
+	m.Unlock(context.Background())
+}
+
+func redis_locks(t *testing.T, ttl time.Duration, opts ...Option) (*RedisLocks, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewRedisLocks(redis.NewClient(&redis.Options{Addr: s.Addr()}), "/backends", ttl, opts...), s
+}
+
+func TestLocker(t *testing.T) {
+	statter := &record_statter{counters: make(map[string]int), timings: make(map[string]int)}
+	locks, s := redis_locks(t, 0, WithServiceID("redis"), WithStatter(statter))
+	defer s.Close()
+	other := other_server()
+	defer other.close()
+
+	tests := []struct {
+		name    string
+		m1, m2  Locker
+		service string // of m2
+		inspect func(ctx context.Context, key string) (*LockInfo, error)
+	}{
+		{"etcd", NewMutex("locker"), other.new_mutex("locker"), "other", Inspect},
+		{"redis", locks.NewMutex("locker"), locks.NewMutex("locker"), "redis", locks.Inspect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m1, m2 := tt.m1, tt.m2
+			if err := m1.Lock(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-m1.Done():
+				t.Fatal("done while held")
+			default:
+			}
+
+			if err := m2.TryLock(context.Background()); err != ErrLocked {
+				t.Fatalf("trylock err %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := m2.Lock(ctx); err != context.DeadlineExceeded {
+				t.Fatalf("lock err %v", err)
+			}
+
+			// the waiter gets the lock once the holder unlocks
+			locked := make(chan error)
+			go func() { locked <- m2.Lock(context.Background()) }()
+			time.Sleep(100 * time.Millisecond)
+			token := m1.Token()
+			if err := m1.Unlock(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-m1.Done():
+			default:
+				t.Fatal("not done after unlock")
+			}
+			if err := <-locked; err != nil {
+				t.Fatal(err)
+			}
+			if m2.Token() <= token {
+				t.Fatalf("token %v after %v", m2.Token(), token)
+			}
+			if info, err := tt.inspect(context.Background(), "locker"); err != nil || len(info.Holders) != 1 || info.Holders[0].Service != tt.service {
+				t.Fatalf("inspect %+v err %v", info, err)
+			}
+
+			if err := m2.Unlock(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := m2.Unlock(context.Background()); err != ErrNotLocked {
+				t.Fatalf("unlock err %v", err)
+			}
+			if err := m1.TryLock(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			m1.Unlock(context.Background())
+		})
+	}
+
+	// on redis, the trylock, the lock timing out and the one waiting were
+	// contended
+	statter.mu.Lock()
+	defer statter.mu.Unlock()
+	if statter.counters["distmutex.contention"] != 3 || statter.timings["distmutex.wait"] != 3 || statter.timings["distmutex.hold"] != 3 {
+		t.Fatalf("metrics %v %v", statter.counters, statter.timings)
+	}
+}
+
+// stuck_mutex is a RedisMutex whose release is never answered
+type stuck_mutex struct {
+	*RedisMutex
+}
+
+func (m stuck_mutex) Unlock(ctx context.Context) error {
+	<-ctx.Done()
+	return m.RedisMutex.Unlock(context.Background())
+}
+
+func TestLockerDoTTL(t *testing.T) {
+	// the release is bound by the ttl of the locks, not LEASE_TIMEOUT
+	locks, s := redis_locks(t, 300*time.Millisecond)
+	defer s.Close()
+
+	start := time.Now()
+	if err := LockerDo(context.Background(), stuck_mutex{locks.NewMutex("ttl")}, func(context.Context) {}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("release took %v", elapsed)
+	}
+}
+
+func TestRedisLockDo(t *testing.T) {
+	locks, s := redis_locks(t, 0)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inside, count := 0, 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := locks.LockDo(context.Background(), "lockdo", func(ctx context.Context) {
+				if _, ok := FencingToken(ctx); !ok {
+					t.Error("no fencing token")
+				}
+
+				mu.Lock()
+				inside++
+				if inside > 1 {
+					t.Error("two holders")
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				inside--
+				count++
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count != 5 {
+		t.Fatalf("ran %v times", count)
+	}
+}
+
+func TestRedisLockLost(t *testing.T) {
+	statter := &record_statter{counters: make(map[string]int), timings: make(map[string]int)}
+	locks, s := redis_locks(t, 300*time.Millisecond, WithStatter(statter))
+	defer s.Close()
+
+	// extended past its ttl while held
+	m := locks.NewMutex("kept")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		s.FastForward(100 * time.Millisecond)
+	}
+	select {
+	case <-m.Done():
+		t.Fatal("lock lost")
+	default:
+	}
+	if err := m.Unlock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// taken over once expired, f is told and LockDo reports it
+	err := locks.LockDo(context.Background(), "lost", func(ctx context.Context) {
+		s.FastForward(time.Second)
+		s.Set("{/backends/lost}", "other")
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("lock loss not noticed")
+		}
+	})
+	if err != ErrLockLost {
+		t.Fatalf("lockdo err %v", err)
+	}
+	statter.mu.Lock()
+	if lost := statter.counters["distmutex.lease_lost"]; lost != 1 {
+		t.Fatalf("%v lease lost", lost)
+	}
+	statter.mu.Unlock()
+
+	// unreachable, f is told before the key may expire
+	locks, s2 := redis_locks(t, 300*time.Millisecond)
+	m = locks.NewMutex("unreachable")
+	if err := m.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s2.Close()
+	expiry := time.Now().Add(300 * time.Millisecond)
+	select {
+	case <-m.Done():
+		if time.Now().After(expiry) {
+			t.Fatalf("lock loss noticed %v after expiry", time.Since(expiry))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock loss not noticed")
+	}
+	m.Unlock(context.Background())
+}
+
 func BenchmarkDistMutex(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		DistMutexLockDo(fmt.Sprint(i), func() {
@@ -27,3 +1026,47 @@ func BenchmarkDistMutex(b *testing.B) {
 		})
 	}
 }
+
+// a session per lock as lockDo used to, to compare with the shared session
+func BenchmarkSessionPerLock(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		res, err := _default_server.client.Grant(context.Background(), LEASE_TIMEOUT)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		session, err := concurrency.NewSession(_default_server.client, concurrency.WithLease(res.ID))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		mux := concurrency.NewMutex(session, "/backends/"+fmt.Sprint(i))
+		if err := mux.Lock(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		session.Orphan()
+		mux.Unlock(context.Background())
+	}
+}
+
+func BenchmarkMutex(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m := NewMutex(fmt.Sprint(i))
+		if err := m.Lock(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		m.Unlock(context.Background())
+	}
+}
+
+func BenchmarkMutexParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m := NewMutex(fmt.Sprint(i))
+			if err := m.Lock(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+			m.Unlock(context.Background())
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package distmutex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/etcd-io/etcd/clientv3/concurrency"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrNoLeader = errors.New("distmutex election has no leader")
+)
+
+// Leadership is the leadership won by Campaign, it lasts until Resign or
+// until the lease of the leader is lost, see Done
+type Leadership struct {
+	session  *concurrency.Session
+	election *concurrency.Election
+}
+
+func (p *server) campaign(ctx context.Context, key, candidate string) (*Leadership, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("locks connection err")
+	}
+
+	// the candidate key is named after the lease, so every campaign has a
+	// session of its own rather than the one shared by the locks
+	session, err := new_session(ctx, p.client, p.ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	election := concurrency.NewElection(session, p.prefix+"/"+key)
+	if err := election.Campaign(ctx, candidate); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &Leadership{session: session, election: election}, nil
+}
+
+// Done is closed when the leadership is lost or resigned
+func (l *Leadership) Done() <-chan struct{} {
+	return l.session.Done()
+}
+
+// Token returns the fencing token of the leadership, see Mutex.Token
+func (l *Leadership) Token() int64 {
+	return l.election.Rev()
+}
+
+// Resign gives up the leadership, the next candidate in line takes it
+func (l *Leadership) Resign(ctx context.Context) error {
+	err := l.election.Resign(ctx)
+	l.session.Close()
+	return err
+}
+
+// observe streams the identity of the leader of the election under pfx
+func (p *server) observe(ctx context.Context, pfx string, out chan<- string) {
+	defer close(out)
+
+	if p.client == nil {
+		log.Errorf("distmutex observe %v err locks connection err", pfx)
+		return
+	}
+
+	last, sent := "", false
+	for retry := time.Duration(1); ; {
+		resp, err := p.client.Get(ctx, pfx, clientv3.WithFirstCreate()...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Errorf("distmutex observe %v err %v", pfx, err)
+			select {
+			case <-time.After(retry * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			if retry < time.Duration(p.ttl) {
+				retry++
+			}
+			continue
+		}
+		retry = 1
+
+		leader := ""
+		if len(resp.Kvs) > 0 {
+			leader = string(resp.Kvs[0].Value)
+		}
+
+		if !sent || leader != last {
+			select {
+			case out <- leader:
+			case <-ctx.Done():
+				return
+			}
+			last, sent = leader, true
+		}
+
+		// any change in line may change the leader
+		wctx, cancel := context.WithCancel(ctx)
+		watch := p.client.Watch(wctx, pfx, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		for wresp := range watch {
+			if len(wresp.Events) > 0 || wresp.Err() != nil {
+				break
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (p *server) leader(ctx context.Context, key string) (string, error) {
+	if p.client == nil {
+		return "", fmt.Errorf("locks connection err")
+	}
+
+	resp, err := p.client.Get(ctx, p.prefix+"/"+key+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return "", ErrNoLeader
+	}
+
+	return string(resp.Kvs[0].Value), nil
+}
+
+// Campaign waits until candidate is elected leader of electionKey or ctx is
+// done, candidates are elected in the order they campaign
+func Campaign(ctx context.Context, electionKey, candidate string) (*Leadership, error) {
+	return _default_server.campaign(ctx, electionKey, candidate)
+}
+
+// Observe streams the identity of the leader of electionKey, the current one
+// first and then every change, "" while there is none. The channel is closed
+// when ctx is done, at once before Init.
+func Observe(ctx context.Context, electionKey string) <-chan string {
+	out := make(chan string)
+	go _default_server.observe(ctx, _default_server.prefix+"/"+electionKey+"/", out)
+	return out
+}
+
+// Leader returns the identity of the current leader of electionKey
+func Leader(ctx context.Context, electionKey string) (string, error) {
+	return _default_server.leader(ctx, electionKey)
+}
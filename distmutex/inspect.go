@@ -0,0 +1,164 @@
+package distmutex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// Identity tells who holds or waits for a lock, it is the value of the
+// holder key
+type Identity struct {
+	Lock     string    `json:"lock"` // key given to NewMutex, NewRWMutex or NewSemaphore
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Service  string    `json:"service"`
+	Queued   time.Time `json:"queued"`
+	Acquired time.Time `json:"acquired"` // zero while waiting
+	Token    int64     `json:"-"`        // fencing token
+}
+
+func (id Identity) String() string {
+	return fmt.Sprintf("%v@%v:%v", id.Service, id.Host, id.PID)
+}
+
+// LockInfo is the state of one lock
+type LockInfo struct {
+	Key     string
+	Holders []Identity // one for a Mutex or writer, up to n for a Semaphore
+	Waiters []Identity // in line
+}
+
+// Statter receives the lock metrics, g2s.Statter satisfies it
+type Statter interface {
+	Counter(sampleRate float32, bucket string, n ...int)
+	Timing(sampleRate float32, bucket string, d ...time.Duration)
+}
+
+type noop_statter struct{}
+
+func (noop_statter) Counter(sampleRate float32, bucket string, n ...int)          {}
+func (noop_statter) Timing(sampleRate float32, bucket string, d ...time.Duration) {}
+
+// WithServiceID names the service in the identity of the holders, the
+// executable name by default
+func WithServiceID(id string) Option {
+	return func(p *server) {
+		p.identity.Service = id
+	}
+}
+
+// WithStatter sends the lock metrics to statter: distmutex.wait and
+// distmutex.hold timings, distmutex.contention and distmutex.lease_lost counters
+func WithStatter(statter Statter) Option {
+	return func(p *server) {
+		p.statter = statter
+	}
+}
+
+// local_identity is the identity of the holders of the process
+func local_identity() Identity {
+	host, _ := os.Hostname()
+	return Identity{Host: host, PID: os.Getpid(), Service: filepath.Base(os.Args[0])}
+}
+
+// parse_identity reads the value of a holder key, false for the keys of other
+// writers as the election candidates
+func parse_identity(kv *mvccpb.KeyValue) (Identity, bool) {
+	var id Identity
+	if err := json.Unmarshal(kv.Value, &id); err != nil || id.Lock == "" {
+		return Identity{Token: kv.CreateRevision}, false
+	}
+
+	id.Token = kv.CreateRevision
+	return id, true
+}
+
+// lock_info sorts the identities of one lock, in line order, into holders and
+// waiters. The holder of a Mutex who did not wait does not write its
+// acquisition, it is the first in line with no acquired time.
+func lock_info(key string, ids []Identity) LockInfo {
+	info := LockInfo{Key: key}
+	for _, id := range ids {
+		if !id.Acquired.IsZero() {
+			info.Holders = append(info.Holders, id)
+		} else {
+			info.Waiters = append(info.Waiters, id)
+		}
+	}
+
+	if len(info.Holders) == 0 && len(info.Waiters) > 0 {
+		first := info.Waiters[0]
+		first.Acquired = first.Queued
+		info.Holders, info.Waiters = []Identity{first}, info.Waiters[1:]
+	}
+
+	return info
+}
+
+func (p *server) inspect(ctx context.Context, key string) (*LockInfo, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("locks connection err")
+	}
+
+	resp, err := p.client.Get(ctx, p.prefix+"/"+key+"/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]Identity, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		id, _ := parse_identity(kv)
+		ids = append(ids, id)
+	}
+
+	info := lock_info(key, ids)
+	return &info, nil
+}
+
+func (p *server) list(ctx context.Context, prefix string) ([]LockInfo, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("locks connection err")
+	}
+
+	resp, err := p.client.Get(ctx, p.prefix+"/"+prefix, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	locks := make(map[string][]Identity)
+	for _, kv := range resp.Kvs {
+		if id, ok := parse_identity(kv); ok && strings.HasPrefix(id.Lock, prefix) {
+			locks[id.Lock] = append(locks[id.Lock], id)
+		}
+	}
+
+	infos := make([]LockInfo, 0, len(locks))
+	for key, ids := range locks {
+		infos = append(infos, lock_info(key, ids))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Inspect returns the holders and waiters of the lock of key, Identity only
+// carries the Token of the keys written by other means, as election candidates
+func Inspect(ctx context.Context, key string) (*LockInfo, error) {
+	return _default_server.inspect(ctx, key)
+}
+
+// List returns the locks held or waited for whose key starts with prefix,
+// sorted by key
+func List(ctx context.Context, prefix string) ([]LockInfo, error) {
+	return _default_server.list(ctx, prefix)
+}
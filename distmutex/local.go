@@ -0,0 +1,143 @@
+package distmutex
+
+import (
+	"context"
+	"sync"
+)
+
+type owner_key struct{}
+
+// owner holds the Mutex locks taken with its ctx, see WithOwner
+type owner struct {
+	held map[string]*reentry // by prefix/key/
+	mu   sync.Mutex
+}
+
+// reentry is a lock held by an owner, m holds it in etcd, count is the
+// number of Lock calls not unlocked yet
+type reentry struct {
+	owner *owner
+	pfx   string
+	m     *Mutex
+	count int
+}
+
+// WithOwner returns a ctx making the Mutex locks reentrant: a Lock or LockDo
+// with this ctx, or one derived from it as the ctx given to f by LockDo, on
+// a key already held by its owner returns at once. The lock is released by
+// the last Unlock. Every goroutine using the ctx shares the owner, ctx is
+// returned as is if it carries an owner already.
+func WithOwner(ctx context.Context) context.Context {
+	if owner_of(ctx) != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, owner_key{}, &owner{held: make(map[string]*reentry)})
+}
+
+func owner_of(ctx context.Context) *owner {
+	o, _ := ctx.Value(owner_key{}).(*owner)
+	return o
+}
+
+// reenter counts one more hold by m of a lock the owner holds already
+func (o *owner) reenter(m *Mutex) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.held[m.pfx]
+	if !ok {
+		return false
+	}
+
+	e.count++
+	m.entry = e
+	return true
+}
+
+// enter records the lock m took in etcd
+func (o *owner) enter(m *Mutex) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	m.entry = &reentry{owner: o, pfx: m.pfx, m: m, count: 1}
+	o.held[m.pfx] = m.entry
+}
+
+// leave counts one hold less and tells whether it was the last one
+func (e *reentry) leave() bool {
+	o := e.owner
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e.count--
+	if e.count > 0 {
+		return false
+	}
+
+	delete(o.held, e.pfx)
+	return true
+}
+
+// local_queue lets one goroutine of the process at a time contend for a key
+// in etcd, the others wait in the process
+type local_queue struct {
+	slot chan struct{}
+	refs int
+}
+
+// local_acquire takes the slot of key, wait tells whether to wait for it,
+// busy whether another goroutine had it
+func (p *server) local_acquire(ctx context.Context, key string, wait bool) (busy bool, err error) {
+	p.local_mu.Lock()
+	if p.local == nil {
+		p.local = make(map[string]*local_queue)
+	}
+	q, ok := p.local[key]
+	if !ok {
+		q = &local_queue{slot: make(chan struct{}, 1)}
+		p.local[key] = q
+	}
+	q.refs++
+	p.local_mu.Unlock()
+
+	select {
+	case q.slot <- struct{}{}:
+		return false, nil
+	default:
+	}
+
+	if wait {
+		select {
+		case q.slot <- struct{}{}:
+			return true, nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	} else {
+		err = ErrLocked
+	}
+
+	p.local_unref(key, q)
+	return true, err
+}
+
+// local_release gives the slot of key to the next goroutine
+func (p *server) local_release(key string) {
+	p.local_mu.Lock()
+	q := p.local[key]
+	p.local_mu.Unlock()
+
+	<-q.slot
+	p.local_unref(key, q)
+}
+
+func (p *server) local_unref(key string, q *local_queue) {
+	p.local_mu.Lock()
+	defer p.local_mu.Unlock()
+
+	q.refs--
+	if q.refs == 0 {
+		delete(p.local, key)
+	}
+}
@@ -0,0 +1,440 @@
+package distmutex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/etcd-io/etcd/clientv3/concurrency"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrLocked    = errors.New("distmutex locked by another holder")
+	ErrNotLocked = errors.New("distmutex not locked")
+)
+
+var closed = make(chan struct{})
+
+type token_key struct{}
+
+func init() {
+	close(closed)
+}
+
+// Locker is a handle on one distributed lock, implemented on etcd by Mutex
+// and on redis by RedisMutex
+type Locker interface {
+	// Lock waits until the lock is held or ctx is done
+	Lock(ctx context.Context) error
+	// TryLock takes the lock if it is free and returns ErrLocked otherwise
+	TryLock(ctx context.Context) error
+	Unlock(ctx context.Context) error
+	// Done is closed when the held lock is lost, and once it is released
+	Done() <-chan struct{}
+	// Token returns the fencing token of the held lock
+	Token() int64
+}
+
+var (
+	_ Locker = (*Mutex)(nil)
+	_ Locker = (*RedisMutex)(nil)
+)
+
+// ttl_locker is a Locker knowing the ttl of its locks
+type ttl_locker interface {
+	timeout() time.Duration
+}
+
+// FencingToken returns the token of the lock held by LockDo from the ctx given to f
+func FencingToken(ctx context.Context) (int64, bool) {
+	token, ok := ctx.Value(token_key{}).(int64)
+	return token, ok
+}
+
+// holder is one contender of a lock, its key is bound to the lease of the
+// process, contenders queue in the order of the create revision of their key
+// as in concurrency.Mutex
+type holder struct {
+	server   *server
+	name     string // key of the lock
+	session  *concurrency.Session
+	my_key   string
+	my_rev   int64
+	identity Identity // value of my_key
+}
+
+// enqueue puts the key of this holder under pfx, ops run in the same txn and
+// their responses are returned
+func (h *holder) enqueue(ctx context.Context, pfx string, ops ...clientv3.Op) ([]*pb.RangeResponse, error) {
+	client := h.server.client
+	if client == nil {
+		return nil, fmt.Errorf("locks connection err")
+	}
+
+	if h.session != nil {
+		return nil, fmt.Errorf("distmutex %v already locked by this handle", pfx)
+	}
+
+	session, err := h.server.get_session(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := h.server.identity
+	identity.Lock, identity.Queued = h.name, time.Now()
+	value, err := json.Marshal(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%v%x_%x", pfx, session.Lease(), atomic.AddUint64(&h.server.seq, 1))
+	cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+	put := clientv3.OpPut(key, string(value), clientv3.WithLease(session.Lease()))
+	get := clientv3.OpGet(key)
+	resp, err := client.Txn(ctx).If(cmp).
+		Then(append([]clientv3.Op{put}, ops...)...).
+		Else(append([]clientv3.Op{get}, ops...)...).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	h.session, h.my_key, h.my_rev, h.identity = session, key, resp.Header.Revision, identity
+	if !resp.Succeeded {
+		h.my_rev = resp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+
+	ranges := make([]*pb.RangeResponse, 0, len(ops))
+	for _, r := range resp.Responses[1:] {
+		ranges = append(ranges, r.GetResponseRange())
+	}
+
+	return ranges, nil
+}
+
+// acquired records the acquisition of the lock requested at since, after
+// waited. The identity is written again with the acquired time when write is
+// set, the holder of a Mutex who did not wait saves the round trip, see lock_info.
+func (h *holder) acquired(ctx context.Context, since time.Time, waited, write bool) {
+	h.identity.Acquired = time.Now()
+	statter := h.server.statter
+	statter.Timing(1.0, "distmutex.wait", h.identity.Acquired.Sub(since))
+	if waited {
+		statter.Counter(1.0, "distmutex.contention", 1)
+	}
+
+	if !write {
+		return
+	}
+
+	value, err := json.Marshal(h.identity)
+	if err == nil {
+		_, err = h.server.client.Put(ctx, h.my_key, string(value), clientv3.WithIgnoreLease())
+	}
+	if err != nil {
+		log.Warnf("distmutex %v identity err %v", h.my_key, err)
+	}
+}
+
+func (h *holder) unlock(ctx context.Context) error {
+	if h.session == nil {
+		return ErrNotLocked
+	}
+
+	if !h.identity.Acquired.IsZero() {
+		h.server.statter.Timing(1.0, "distmutex.hold", time.Since(h.identity.Acquired))
+	}
+
+	// the key is dropped with the lease anyway if the delete fails
+	_, err := h.server.client.Delete(ctx, h.my_key)
+	h.session, h.my_key, h.my_rev, h.identity = nil, "", 0, Identity{}
+	return err
+}
+
+// release gives up a lock that was not acquired
+func (h *holder) release() {
+	h.server.statter.Counter(1.0, "distmutex.contention", 1)
+
+	ctx, cancel := context.WithTimeout(h.server.client.Ctx(), h.server.timeout())
+	defer cancel()
+	h.unlock(ctx)
+}
+
+// Done is closed when the lease of the held lock is lost, e.g. after a
+// partition from etcd longer than the ttl, or on Close
+func (h *holder) Done() <-chan struct{} {
+	if h.session == nil {
+		return closed
+	}
+
+	return h.session.Done()
+}
+
+// Token returns the fencing token of the held lock, the create revision of
+// its key, which grows with every holder. Storage written under the lock
+// should refuse tokens lower than the last one seen, see the db fenced helpers.
+func (h *holder) Token() int64 {
+	return h.my_rev
+}
+
+// Key returns the lock key of the held lock
+func (h *holder) Key() string {
+	return h.my_key
+}
+
+// hold runs f under an acquired lock and releases it with unlock, the ctx of
+// f carries the fencing token and is cancelled when ctx is done or the lock
+// is lost, ErrLockLost is returned in the latter case. The release is bounded
+// by timeout, and skipped for a lost lock whose key expires anyway, so that
+// a partition from the store does not block it.
+func hold(ctx context.Context, done <-chan struct{}, token int64, unlock func(context.Context) error, timeout time.Duration, f func(context.Context)) error {
+	fctx, cancel := context.WithCancel(context.WithValue(ctx, token_key{}, token))
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-fctx.Done():
+		}
+	}()
+
+	f(fctx)
+	cancel()
+
+	lost := false
+	select {
+	case <-done:
+		lost = true
+	default:
+	}
+
+	// a done ctx lets unlock reset the handle without a request
+	uctx, ucancel := context.WithTimeout(context.Background(), timeout)
+	if lost {
+		ucancel()
+	}
+	err := unlock(uctx)
+	ucancel()
+
+	if lost {
+		return ErrLockLost
+	}
+
+	return err
+}
+
+// Mutex is a distributed lock on one key, holders queue under prefix/key/.
+// The key is bound to the lease of the process, see Done. The goroutines of
+// the process wait for each other before queueing in etcd, so a key has one
+// holder key per process at most.
+// A Mutex is held by one goroutine at a time, it can be locked again after
+// Unlock, see WithOwner for reentrant locks.
+type Mutex struct {
+	holder
+	pfx   string   // prefix/key/
+	entry *reentry // while locked with an owner
+}
+
+func (p *server) new_mutex(key string) *Mutex {
+	return &Mutex{holder: holder{server: p, name: key}, pfx: p.prefix + "/" + key + "/"}
+}
+
+// NewMutex returns an unlocked handle on key
+func NewMutex(key string) *Mutex {
+	return _default_server.new_mutex(key)
+}
+
+// Lock waits until the lock is held or ctx is done
+func (m *Mutex) Lock(ctx context.Context) error {
+	return m.lock(ctx, true)
+}
+
+// TryLock takes the lock if it is free and returns ErrLocked otherwise,
+// without waiting for the holder
+func (m *Mutex) TryLock(ctx context.Context) error {
+	return m.lock(ctx, false)
+}
+
+func (m *Mutex) lock(ctx context.Context, wait bool) error {
+	if m.session != nil || m.entry != nil {
+		return fmt.Errorf("distmutex %v already locked by this handle", m.pfx)
+	}
+
+	o := owner_of(ctx)
+	if o != nil && o.reenter(m) {
+		return nil
+	}
+
+	since := time.Now()
+	busy, err := m.server.local_acquire(ctx, m.pfx, wait)
+	if err != nil {
+		if busy {
+			m.server.statter.Counter(1.0, "distmutex.contention", 1)
+		}
+		return err
+	}
+
+	acquired, err := m.acquire(ctx)
+	if err == nil && !acquired {
+		if wait {
+			_, err = wait_deletes(ctx, m.server.client, m.pfx, m.my_rev-1)
+		} else {
+			err = ErrLocked
+		}
+
+		if err != nil {
+			m.release()
+		}
+	}
+	if err != nil {
+		m.server.local_release(m.pfx)
+		return err
+	}
+
+	m.acquired(ctx, since, busy || !acquired, !acquired)
+	if o != nil {
+		o.enter(m)
+	}
+
+	return nil
+}
+
+// Unlock releases the lock, ctx bounds the delete of the lock key. A lock
+// held again by its owner is released by the last Unlock.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	e := m.entry
+	if e == nil {
+		return m.unlock_held(ctx)
+	}
+
+	m.entry = nil
+	if !e.leave() {
+		return nil
+	}
+
+	return e.m.unlock_held(ctx)
+}
+
+func (m *Mutex) unlock_held(ctx context.Context) error {
+	if m.session == nil {
+		return ErrNotLocked
+	}
+
+	err := m.unlock(ctx)
+	m.server.local_release(m.pfx)
+	return err
+}
+
+// held is the holder of the lock in etcd, another handle of the owner when
+// locked again
+func (m *Mutex) held() *holder {
+	if m.entry != nil {
+		return &m.entry.m.holder
+	}
+
+	return &m.holder
+}
+
+// Done is closed when the lease of the held lock is lost, e.g. after a
+// partition from etcd longer than the ttl, or on Close
+func (m *Mutex) Done() <-chan struct{} {
+	return m.held().Done()
+}
+
+// Token returns the fencing token of the held lock, see holder.Token
+func (m *Mutex) Token() int64 {
+	return m.held().Token()
+}
+
+func (m *Mutex) timeout() time.Duration {
+	return m.server.timeout()
+}
+
+// Key returns the lock key of the held lock
+func (m *Mutex) Key() string {
+	return m.held().Key()
+}
+
+// acquire puts the key of this holder and tells whether it is the first in line
+func (m *Mutex) acquire(ctx context.Context) (bool, error) {
+	resp, err := m.enqueue(ctx, m.pfx, clientv3.OpGet(m.pfx, clientv3.WithFirstCreate()...))
+	if err != nil {
+		return false, err
+	}
+
+	kvs := resp[0].Kvs
+	return len(kvs) == 0 || kvs[0].CreateRevision == m.my_rev, nil
+}
+
+// wait_deletes waits until every key under pfx created up to max_rev is
+// deleted and tells whether there was any
+func wait_deletes(ctx context.Context, client *clientv3.Client, pfx string, max_rev int64) (bool, error) {
+	opts := append(clientv3.WithLastCreate(), clientv3.WithMaxCreateRev(max_rev))
+	for waited := false; ; waited = true {
+		resp, err := client.Get(ctx, pfx, opts...)
+		if err != nil {
+			return waited, err
+		}
+
+		if len(resp.Kvs) == 0 {
+			return waited, nil
+		}
+
+		if err := wait_delete(ctx, client, string(resp.Kvs[0].Key), resp.Header.Revision); err != nil {
+			return true, err
+		}
+	}
+}
+
+// wait_delete waits for a delete of key after revision rev, opts as
+// clientv3.WithPrefix widen the watched keys
+func wait_delete(ctx context.Context, client *clientv3.Client, key string, rev int64, opts ...clientv3.OpOption) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for resp := range client.Watch(wctx, key, append(opts, clientv3.WithRev(rev))...) {
+		for _, ev := range resp.Events {
+			if ev.Type == mvccpb.DELETE {
+				return nil
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("distmutex lost watcher waiting for delete of %v", key)
+}
+
+// LockDo runs f under the lock of key, it returns without running f when the
+// lock is not acquired before ctx is done. The ctx given to f carries the
+// fencing token, see FencingToken, and is cancelled when ctx is done or the
+// lock is lost, in which case LockDo returns ErrLockLost once f returns.
+func LockDo(ctx context.Context, key string, f func(ctx context.Context)) error {
+	return _default_server.lockDo(ctx, key, f)
+}
+
+// LockerDo runs f under l with the semantics of LockDo, the release is bound
+// by the ttl of the locks of l, LEASE_TIMEOUT seconds for other Lockers
+func LockerDo(ctx context.Context, l Locker, f func(ctx context.Context)) error {
+	timeout := LEASE_TIMEOUT * time.Second
+	if l, ok := l.(ttl_locker); ok {
+		timeout = l.timeout()
+	}
+	return locker_do(ctx, l, timeout, f)
+}
+
+// locker_do is LockerDo releasing l within timeout
+func locker_do(ctx context.Context, l Locker, timeout time.Duration, f func(ctx context.Context)) error {
+	if err := l.Lock(ctx); err != nil {
+		return err
+	}
+
+	return hold(ctx, l.Done(), l.Token(), l.Unlock, timeout, f)
+}
@@ -0,0 +1,112 @@
+package distmutex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	ONCE_SUFFIX = ".done" // the completion marker of key is prefix/key.done
+)
+
+// Completion is the marker of a successful run of Once
+type Completion struct {
+	At     time.Time `json:"at"`
+	Result string    `json:"result"` // returned by f
+	Token  int64     `json:"token"`  // fencing token of the run
+	Holder Identity  `json:"holder"` // who ran it
+}
+
+// once runs f under the lock of key unless a run completed at since or
+// later, a zero since accepts any completed run
+func (p *server) once(ctx context.Context, key string, since time.Time, f func(ctx context.Context) (string, error)) (*Completion, error) {
+	m := p.new_mutex(key)
+	if err := m.Lock(ctx); err != nil {
+		return nil, err
+	}
+
+	marker := p.prefix + "/" + key + ONCE_SUFFIX
+	var completion *Completion
+	var err error
+	lock_err := hold(ctx, m.Done(), m.Token(), m.Unlock, p.timeout(), func(ctx context.Context) {
+		completion, err = p.completion(ctx, marker)
+		if err != nil || (completion != nil && !completion.At.Before(since)) {
+			return
+		}
+
+		// a failed run leaves the marker as it is
+		result, ferr := f(ctx)
+		if ferr != nil {
+			completion, err = nil, ferr
+			return
+		}
+
+		completion = &Completion{At: time.Now(), Result: result, Token: m.Token(), Holder: m.identity}
+		value, jerr := json.Marshal(completion)
+		if jerr != nil {
+			completion, err = nil, jerr
+			return
+		}
+
+		// written only while the lock is held
+		resp, terr := p.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(m.Key()), "=", m.Token())).
+			Then(clientv3.OpPut(marker, string(value))).Commit()
+		switch {
+		case terr != nil:
+			completion, err = nil, terr
+		case !resp.Succeeded:
+			completion, err = nil, ErrLockLost
+		}
+	})
+	if err == nil {
+		err = lock_err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return completion, nil
+}
+
+// completion reads the marker, nil if unset
+func (p *server) completion(ctx context.Context, marker string) (*Completion, error) {
+	resp, err := p.client.Get(ctx, marker)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+
+	completion := &Completion{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, completion); err != nil {
+		return nil, fmt.Errorf("distmutex %v malformed marker: %v", marker, err)
+	}
+
+	return completion, nil
+}
+
+// Once runs f under the lock of key unless a run of f completed before, across
+// the processes sharing the prefix, and returns the completion of the run.
+// The result of f is recorded on success only, a failed run returns its error
+// and is tried again by the next Once.
+func Once(ctx context.Context, key string, f func(ctx context.Context) (string, error)) (*Completion, error) {
+	return _default_server.once(ctx, key, time.Time{}, f)
+}
+
+// OncePer is Once for a job run once per period, the periods are aligned on
+// the wall clock since the zero time, e.g. on UTC days for 24h
+func OncePer(ctx context.Context, key string, period time.Duration, f func(ctx context.Context) (string, error)) (*Completion, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("distmutex invalid period %v", period)
+	}
+
+	return _default_server.once(ctx, key, time.Now().Truncate(period), f)
+}
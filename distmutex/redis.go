@@ -0,0 +1,304 @@
+package distmutex
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	REDIS_RETRY_INTERVAL = 50 * time.Millisecond // between the attempts of a waiting Lock
+)
+
+// takes KEYS[1] for ARGV[1] during ARGV[2] ms and returns the next fencing
+// token from KEYS[2], 0 if the lock is held
+const redis_acquire = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`
+
+// drops KEYS[1] if still held by ARGV[1]
+const redis_release = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// extends KEYS[1] to ARGV[2] ms if still held by ARGV[1]
+const redis_extend = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// RedisLocks creates the locks kept in redis under prefix, for deployments
+// without etcd. A held lock expires after ttl unless its holder extends it,
+// which a goroutine does every ttl/3 until Unlock.
+type RedisLocks struct {
+	client   redis.UniversalClient
+	prefix   string
+	ttl      time.Duration
+	identity Identity // of the holders of the process
+	statter  Statter
+}
+
+// NewRedisLocks keeps the locks in the redis standalone server, sentinel
+// group or cluster of client, ttl <= 0 means LEASE_TIMEOUT seconds. Of the
+// options, WithServiceID and WithStatter apply, the metrics are those of etcd.
+func NewRedisLocks(client redis.UniversalClient, prefix string, ttl time.Duration, opts ...Option) *RedisLocks {
+	if ttl <= 0 {
+		ttl = LEASE_TIMEOUT * time.Second
+	}
+
+	p := &server{identity: local_identity(), statter: noop_statter{}}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return &RedisLocks{client: client, prefix: prefix, ttl: ttl, identity: p.identity, statter: p.statter}
+}
+
+// NewMutex returns an unlocked handle on key
+func (r *RedisLocks) NewMutex(key string) *RedisMutex {
+	// the hash tag keeps the lock and its fencing counter in one cluster slot
+	name := "{" + r.prefix + "/" + key + "}"
+	return &RedisMutex{locks: r, name: key, key: name, fence_key: name + ".fence"}
+}
+
+// Inspect returns the holder of the lock of key, redis keeps no waiters
+func (r *RedisLocks) Inspect(ctx context.Context, key string) (*LockInfo, error) {
+	m := r.NewMutex(key)
+	cmd := redis.NewStringCmd("get", m.key)
+	if err := r.client.ProcessContext(ctx, cmd); err == redis.Nil {
+		return &LockInfo{Key: key}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var value redis_value
+	if err := json.Unmarshal([]byte(cmd.Val()), &value); err != nil {
+		return nil, err
+	}
+
+	return &LockInfo{Key: key, Holders: []Identity{value.Identity}}, nil
+}
+
+// LockDo runs f under the lock of key with the semantics of LockDo
+func (r *RedisLocks) LockDo(ctx context.Context, key string, f func(ctx context.Context)) error {
+	return locker_do(ctx, r.NewMutex(key), r.ttl, f)
+}
+
+// eval runs a script bound by ctx
+func (r *RedisLocks) eval(ctx context.Context, script string, keys []string, args ...interface{}) (int64, error) {
+	cmd_args := make([]interface{}, 0, 3+len(keys)+len(args))
+	cmd_args = append(cmd_args, "eval", script, len(keys))
+	for _, key := range keys {
+		cmd_args = append(cmd_args, key)
+	}
+	cmd := redis.NewCmd(append(cmd_args, args...)...)
+	if err := r.client.ProcessContext(ctx, cmd); err != nil {
+		return 0, err
+	}
+
+	n, ok := cmd.Val().(int64)
+	if !ok {
+		return 0, fmt.Errorf("distmutex unexpected redis reply %v", cmd.Val())
+	}
+
+	return n, nil
+}
+
+// redis_value is the value of a held lock, ID is unique to the holder
+type redis_value struct {
+	Identity
+	ID string `json:"id"`
+}
+
+// RedisMutex is a lock kept in redis, see RedisLocks. It is held by one
+// goroutine at a time and can be locked again after Unlock.
+type RedisMutex struct {
+	locks     *RedisLocks
+	name      string // key of the lock
+	key       string
+	fence_key string
+	value     string // unique to the holder, checked on extend and release
+	token     int64  // fencing token
+	acquired  time.Time
+	done      chan struct{} // closed when the lock is lost or released
+	stop      chan struct{} // stops the extension
+	wg        sync.WaitGroup
+}
+
+// Lock waits until the lock is held or ctx is done
+func (m *RedisMutex) Lock(ctx context.Context) error {
+	since := time.Now()
+	for waited := false; ; waited = true {
+		acquired, err := m.acquire(ctx, since)
+		if err != nil && ctx.Err() != nil {
+			// the request was cut by ctx, not refused
+			return ctx.Err()
+		}
+		if err != nil || acquired {
+			return err
+		}
+
+		if !waited {
+			m.locks.statter.Counter(1.0, "distmutex.contention", 1)
+		}
+
+		select {
+		case <-time.After(REDIS_RETRY_INTERVAL):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryLock takes the lock if it is free and returns ErrLocked otherwise
+func (m *RedisMutex) TryLock(ctx context.Context) error {
+	acquired, err := m.acquire(ctx, time.Now())
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		m.locks.statter.Counter(1.0, "distmutex.contention", 1)
+		return ErrLocked
+	}
+
+	return nil
+}
+
+// Unlock releases the lock, it returns ErrLockLost if the lock expired before
+func (m *RedisMutex) Unlock(ctx context.Context) error {
+	if m.done == nil {
+		return ErrNotLocked
+	}
+
+	m.locks.statter.Timing(1.0, "distmutex.hold", time.Since(m.acquired))
+	close(m.stop)
+	m.wg.Wait()
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+
+	n, err := m.locks.eval(ctx, redis_release, []string{m.key}, m.value)
+	m.value, m.token, m.acquired, m.done, m.stop = "", 0, time.Time{}, nil, nil
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// Done is closed when the held lock is lost, i.e. not extended within its
+// ttl, or released
+func (m *RedisMutex) Done() <-chan struct{} {
+	if m.done == nil {
+		return closed
+	}
+
+	return m.done
+}
+
+// Token returns the fencing token of the held lock, it grows with every holder
+func (m *RedisMutex) Token() int64 {
+	return m.token
+}
+
+func (m *RedisMutex) timeout() time.Duration {
+	return m.locks.ttl
+}
+
+// acquire makes one attempt of a Lock called at since
+func (m *RedisMutex) acquire(ctx context.Context, since time.Time) (bool, error) {
+	if m.done != nil {
+		return false, fmt.Errorf("distmutex %v already locked by this handle", m.key)
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return false, err
+	}
+	identity := m.locks.identity
+	identity.Lock, identity.Queued, identity.Acquired = m.name, since, time.Now()
+	value, err := json.Marshal(redis_value{Identity: identity, ID: hex.EncodeToString(random)})
+	if err != nil {
+		return false, err
+	}
+
+	ttl, sent := m.locks.ttl, time.Now()
+	token, err := m.locks.eval(ctx, redis_acquire, []string{m.key, m.fence_key}, string(value), int64(ttl/time.Millisecond))
+	if err != nil || token == 0 {
+		return false, err
+	}
+
+	m.value, m.token, m.acquired = string(value), token, identity.Acquired
+	m.locks.statter.Timing(1.0, "distmutex.wait", identity.Acquired.Sub(since))
+	m.done, m.stop = make(chan struct{}), make(chan struct{})
+	m.wg.Add(1)
+	go m.extend(m.value, sent, m.done, m.stop)
+	return true, nil
+}
+
+// extend keeps the lock while it is held, the key is valid for ttl from the
+// sending of the last successful request, from sent at first. done is closed
+// once the lock is taken over, or when the key may expire before the next
+// attempt is answered, so f stops before another process can hold the lock.
+func (m *RedisMutex) extend(value string, sent time.Time, done, stop chan struct{}) {
+	defer m.wg.Done()
+
+	ttl := m.locks.ttl
+	interval, timeout := ttl/3, ttl/6
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	valid := sent.Add(ttl)
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		sent := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		n, err := m.locks.eval(ctx, redis_extend, []string{m.key}, value, int64(ttl/time.Millisecond))
+		cancel()
+		switch {
+		case err == nil && n == 1:
+			valid = sent.Add(ttl)
+			continue
+		case err == nil:
+			log.Warnf("distmutex %v lost", m.key)
+		case time.Until(valid) < interval+timeout:
+			log.Warnf("distmutex %v lost, extend err %v", m.key, err)
+		default:
+			continue
+		}
+
+		m.locks.statter.Counter(1.0, "distmutex.lease_lost", 1)
+		close(done)
+		return
+	}
+}
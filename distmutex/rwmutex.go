@@ -0,0 +1,64 @@
+package distmutex
+
+import (
+	"context"
+)
+
+// RWMutex is a distributed read-write lock on one key, held by many readers
+// or one writer. Readers and writers queue together under prefix/key/, a
+// reader waits for the writers queued before it only, a writer for everyone
+// before it, so a waiting writer is not starved by readers arriving later.
+type RWMutex struct {
+	holder
+	pfx string // prefix/key/, readers under r/ and writers under w/
+}
+
+func (p *server) new_rwmutex(key string) *RWMutex {
+	return &RWMutex{holder: holder{server: p, name: key}, pfx: p.prefix + "/" + key + "/"}
+}
+
+// NewRWMutex returns an unlocked handle on key, the key must not be used by
+// a Mutex or Semaphore as well
+func NewRWMutex(key string) *RWMutex {
+	return _default_server.new_rwmutex(key)
+}
+
+// RLock waits until the lock is held for reading or ctx is done
+func (rw *RWMutex) RLock(ctx context.Context) error {
+	if _, err := rw.enqueue(ctx, rw.pfx+"r/"); err != nil {
+		return err
+	}
+
+	waited, err := wait_deletes(ctx, rw.server.client, rw.pfx+"w/", rw.my_rev-1)
+	if err != nil {
+		rw.release()
+		return err
+	}
+
+	rw.acquired(ctx, rw.identity.Queued, waited, true)
+	return nil
+}
+
+// Lock waits until the lock is held for writing or ctx is done
+func (rw *RWMutex) Lock(ctx context.Context) error {
+	if _, err := rw.enqueue(ctx, rw.pfx+"w/"); err != nil {
+		return err
+	}
+
+	waited, err := wait_deletes(ctx, rw.server.client, rw.pfx, rw.my_rev-1)
+	if err != nil {
+		rw.release()
+		return err
+	}
+
+	rw.acquired(ctx, rw.identity.Queued, waited, true)
+	return nil
+}
+
+func (rw *RWMutex) RUnlock(ctx context.Context) error {
+	return rw.unlock(ctx)
+}
+
+func (rw *RWMutex) Unlock(ctx context.Context) error {
+	return rw.unlock(ctx)
+}
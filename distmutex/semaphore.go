@@ -0,0 +1,104 @@
+package distmutex
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+// Semaphore is a distributed counting semaphore on one key, at most n
+// holders at a time across the cluster. Holders queue under prefix/key/ and
+// the first n of them hold it, every handle on a key must use the same n.
+type Semaphore struct {
+	holder
+	pfx string // prefix/key/
+	n   int64
+}
+
+func (p *server) new_semaphore(key string, n int) (*Semaphore, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("distmutex invalid semaphore size %v", n)
+	}
+
+	return &Semaphore{holder: holder{server: p, name: key}, pfx: p.prefix + "/" + key + "/", n: int64(n)}, nil
+}
+
+// NewSemaphore returns a handle on key admitting n holders, n >= 1. The key
+// must not be used by a Mutex or RWMutex as well.
+func NewSemaphore(key string, n int) (*Semaphore, error) {
+	return _default_server.new_semaphore(key, n)
+}
+
+// Acquire waits until the semaphore is held or ctx is done
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	count, err := s.enter(ctx)
+	if err != nil {
+		return err
+	}
+
+	// wait for holders before this one to leave
+	client, rev, waited := s.server.client, s.my_rev, count > s.n
+	for count > s.n {
+		if err := wait_delete(ctx, client, s.pfx, rev+1, clientv3.WithPrefix()); err != nil {
+			s.release()
+			return err
+		}
+
+		resp, err := client.Get(ctx, s.pfx, clientv3.WithPrefix(), clientv3.WithMaxCreateRev(s.my_rev), clientv3.WithCountOnly())
+		if err != nil {
+			s.release()
+			return err
+		}
+		count, rev = resp.Count, resp.Header.Revision
+	}
+
+	s.acquired(ctx, s.identity.Queued, waited, true)
+	return nil
+}
+
+// TryAcquire takes the semaphore if fewer than n hold it and returns
+// ErrLocked otherwise, without waiting
+func (s *Semaphore) TryAcquire(ctx context.Context) error {
+	count, err := s.enter(ctx)
+	if err != nil {
+		return err
+	}
+
+	if count > s.n {
+		s.release()
+		return ErrLocked
+	}
+
+	s.acquired(ctx, s.identity.Queued, false, true)
+	return nil
+}
+
+func (s *Semaphore) Release(ctx context.Context) error {
+	return s.unlock(ctx)
+}
+
+// enter puts the key of this holder and returns its position in line
+func (s *Semaphore) enter(ctx context.Context) (int64, error) {
+	resp, err := s.enqueue(ctx, s.pfx, clientv3.OpGet(s.pfx, clientv3.WithPrefix(), clientv3.WithCountOnly()))
+	if err != nil {
+		return 0, err
+	}
+
+	return resp[0].Count, nil
+}
+
+// SemaphoreDo runs f holding the semaphore of key admitting n holders, with
+// the semantics of LockDo
+func SemaphoreDo(ctx context.Context, key string, n int, f func(ctx context.Context)) error {
+	s, err := _default_server.new_semaphore(key, n)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Acquire(ctx); err != nil {
+		return err
+	}
+
+	return hold(ctx, s.Done(), s.Token(), s.Release, s.server.timeout(), f)
+}
@@ -0,0 +1,110 @@
+package servicestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the on-disk snapshot behind WithCacheFile
+type cache_snapshot struct {
+	Root          string                 `json:"root"`
+	Revision      int64                  `json:"revision"`
+	NumberPrefixs []string               `json:"number_prefixs"`
+	Values        map[string]cache_value `json:"values"`
+}
+
+type cache_value struct {
+	Value    string `json:"value"`
+	Revision int64  `json:"revision"`
+}
+
+// save_cache writes the etcd layer to the cache file if it changed since
+// the last write, the file is replaced atomically
+func (p *Store) save_cache() {
+	if p.cache_file == "" {
+		return
+	}
+
+	p.mu.RLock()
+	if p.stale || p.revision == p.cache_revision {
+		p.mu.RUnlock()
+		return
+	}
+
+	snapshot := cache_snapshot{
+		Root:     p.root,
+		Revision: p.revision,
+		Values:   make(map[string]cache_value, len(p.layers[LAYER_ETCD])),
+	}
+	for k := range p.number_prefixs {
+		snapshot.NumberPrefixs = append(snapshot.NumberPrefixs, k)
+	}
+	for k, v := range p.layers[LAYER_ETCD] {
+		snapshot.Values[k] = cache_value{Value: v.value, Revision: v.revision}
+	}
+	p.mu.RUnlock()
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Errorf("servicestate %v cache err %v", p.root, err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.cache_file), filepath.Base(p.cache_file))
+	if err != nil {
+		log.Errorf("servicestate %v cache err %v", p.root, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(bytes)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.cache_file)
+	}
+	if err != nil {
+		log.Errorf("servicestate %v cache err %v", p.root, err)
+		return
+	}
+
+	p.mu.Lock()
+	p.cache_revision = snapshot.Revision
+	p.mu.Unlock()
+}
+
+// load_cache fills the store from the cache file and marks it stale
+func (p *Store) load_cache() error {
+	bytes, err := ioutil.ReadFile(p.cache_file)
+	if err != nil {
+		return err
+	}
+
+	var snapshot cache_snapshot
+	if err := json.Unmarshal(bytes, &snapshot); err != nil {
+		return err
+	}
+
+	if snapshot.Root != p.root {
+		return fmt.Errorf("cache %v was written for %v", p.cache_file, snapshot.Root)
+	}
+
+	p.mu.Lock()
+	p.load_number_prefixs(strings.Join(snapshot.NumberPrefixs, " "))
+	p.stale = true
+	p.mu.Unlock()
+
+	for k, v := range snapshot.Values {
+		p.set(k, v.Value, v.Revision)
+	}
+
+	p.set_revision(snapshot.Revision)
+	return nil
+}
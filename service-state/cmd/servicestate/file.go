@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	servicestate "github.com/xymodule/libs/service-state"
+	"sigs.k8s.io/yaml"
+)
+
+// files hold category -> service -> value
+func export(w io.Writer, values map[string]string, format string) error {
+	tree := make(map[string]map[string]string)
+	for k, v := range values {
+		category, service := split(k)
+		if _, ok := tree[category]; !ok {
+			tree[category] = make(map[string]string)
+		}
+		tree[category][service] = v
+	}
+
+	var bytes []byte
+	var err error
+	switch format {
+	case "json":
+		bytes, err = json.MarshalIndent(tree, "", "  ")
+		bytes = append(bytes, '\n')
+	case "yaml":
+		bytes, err = yaml.Marshal(tree)
+	default:
+		err = fmt.Errorf("unknown format %v", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bytes)
+	return err
+}
+
+func diff_file(store *servicestate.Store, file string) error {
+	values, err := servicestate.LoadValues(file)
+	if err != nil {
+		return err
+	}
+
+	live := store.Subtree("")
+	for _, k := range sorted_keys(values) {
+		old, ok := live[k]
+		switch {
+		case !ok:
+			fmt.Printf("+ %v = %q\n", k, values[k])
+		case old != values[k]:
+			fmt.Printf("~ %v: %q -> %q\n", k, old, values[k])
+		}
+	}
+
+	for _, k := range sorted_keys(live) {
+		if _, ok := values[k]; !ok {
+			fmt.Printf("- %v = %q\n", k, live[k])
+		}
+	}
+
+	return nil
+}
+
+// import_file writes nothing unless every value of the file passes validation,
+// variables missing from the file are left alone
+func import_file(ctx context.Context, store *servicestate.Store, file string) error {
+	values, err := servicestate.LoadValues(file)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, k := range sorted_keys(values) {
+		category, service := split(k)
+		if values[k] == servicestate.REDACTED && store.IsSecret(category, service) {
+			continue
+		}
+		if err := store.Validate(category, service, values[k]); err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", k, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("import %v refused:\n%v", file, strings.Join(errs, "\n"))
+	}
+
+	live := store.Subtree("")
+	written := 0
+	for _, k := range sorted_keys(values) {
+		if old, ok := live[k]; ok && old == values[k] {
+			continue
+		}
+
+		// exported secrets are redacted, keep their value
+		category, service := split(k)
+		if values[k] == servicestate.REDACTED && store.IsSecret(category, service) {
+			continue
+		}
+
+		if err := store.UpdateGlobalVar(ctx, category, service, values[k]); err != nil {
+			return fmt.Errorf("import %v at %v err %v, %v values written", file, k, err, written)
+		}
+		written++
+	}
+
+	fmt.Printf("%v values written\n", written)
+	return nil
+}
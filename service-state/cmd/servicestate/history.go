@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	servicestate "github.com/xymodule/libs/service-state"
+)
+
+func revision(arg string) int64 {
+	rev, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		fatal(fmt.Errorf("bad revision %v", arg))
+	}
+
+	return rev
+}
+
+func history(ctx context.Context, store *servicestate.Store, args []string) error {
+	if len(args) < 3 {
+		usage()
+	}
+	path, key := args[1], args[2]
+
+	switch args[0] {
+	case "list":
+		changes, err := store.History(ctx, path, key)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range changes {
+			fmt.Printf("%v\t%v\t%v\t%q -> %q\n", c.Revision, c.Time.Format(time.RFC3339), c.Writer, c.OldValue, c.NewValue)
+		}
+	case "diff":
+		if len(args) < 4 {
+			usage()
+		}
+
+		to := int64(-1)
+		if len(args) > 4 {
+			to = revision(args[4])
+		}
+
+		return diff(ctx, store, path, key, revision(args[3]), to)
+	case "restore":
+		if len(args) < 4 {
+			usage()
+		}
+
+		rev := revision(args[3])
+		if err := store.Rollback(ctx, path, key, rev); err != nil {
+			return err
+		}
+
+		fmt.Printf("%v/%v restored to revision %v\n", path, key, rev)
+	default:
+		usage()
+	}
+
+	return nil
+}
+
+// diff prints the values at two revisions, to < 0 meaning the latest
+func diff(ctx context.Context, store *servicestate.Store, path, key string, from, to int64) error {
+	if to < 0 {
+		changes, err := store.History(ctx, path, key)
+		if err != nil {
+			return err
+		}
+
+		if len(changes) == 0 {
+			return fmt.Errorf("%v/%v has no history", path, key)
+		}
+		to = changes[len(changes)-1].Revision
+	}
+
+	old, err := store.ValueAt(ctx, path, key, from)
+	if err != nil {
+		return err
+	}
+
+	value, err := store.ValueAt(ctx, path, key, to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("--- %v/%v@%v\n+++ %v/%v@%v\n", path, key, from, path, key, to)
+	if old == value {
+		return nil
+	}
+
+	if store.IsSecret(path, key) && !*reveal {
+		old, value = servicestate.REDACTED, servicestate.REDACTED
+	}
+
+	fmt.Printf("-%v\n+%v\n", old, value)
+	return nil
+}
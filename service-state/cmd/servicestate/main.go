@@ -0,0 +1,249 @@
+// servicestate inspects and edits the variables of a servicestate root,
+// values are checked with the library's validation before they are written
+//
+//	servicestate -etcd http://127.0.0.1:2379 -root /backends list
+//	servicestate -schema schema.yaml set online game1 10
+//	servicestate export > backends.yaml
+//	servicestate diff backends.yaml
+//	servicestate import backends.yaml
+//	servicestate -keyfile keys -schema schema.yaml set db password s3cret
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+
+	servicestate "github.com/xymodule/libs/service-state"
+)
+
+var (
+	etcd_hosts = flag.String("etcd", "http://127.0.0.1:2379", "etcd endpoints, comma separated")
+	root       = flag.String("root", "/backends", "servicestate root")
+	timeout    = flag.Duration("timeout", 5*time.Second, "etcd request timeout")
+	schema     = flag.String("schema", "", "schema file (.yaml/.json) the services validate with")
+	format     = flag.String("format", "yaml", "export format, yaml or json")
+	key_file   = flag.String("keyfile", "", "key file of the secret variables, secrets are encrypted on write")
+	reveal     = flag.Bool("reveal", false, "print secrets decrypted with get and history diff")
+	histories  = flag.String("history", "**", "patterns of the variables whose writes are recorded, comma separated")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: servicestate [flags] command args...
+
+variables are addressed as <category> <service>, the category may span levels
+
+commands:
+  get <category> <service>                     print a value
+  set <category> <service> <value>             validate and write a value
+  list [prefix]                                list the values below prefix
+  watch [prefix]                               print the changes below prefix
+  export [prefix]                              write the values below prefix to stdout
+  diff <file>                                  compare an exported file with etcd
+  import <file>                                validate every value of a file, then write the changed ones
+  history list <category> <service>            list the recorded writes
+  history diff <category> <service> <rev> [rev]
+                                               compare the values at two revisions, the latest by default
+  history restore <category> <service> <rev>   write back the value held at revision
+  keygen <id>                                  append a new primary key to the key file
+  rotate                                       re-encrypt the secrets with the primary key
+
+secrets, marked in the schema, are encrypted with -keyfile and printed redacted
+
+values of etcd rejected by the schema are not served, list prints them marked
+(rejected), get and export report them on stderr
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func writer() string {
+	u, err := user.Current()
+	if err != nil {
+		return "servicestate-cli"
+	}
+
+	return u.Username + "@servicestate-cli"
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+	}
+
+	// the key file is local, no etcd needed
+	if args[0] == "keygen" {
+		if *key_file == "" || len(args) < 2 {
+			usage()
+		}
+		if err := servicestate.GenerateKey(*key_file, args[1]); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	opts := []servicestate.Option{
+		servicestate.WithTimeout(*timeout),
+		servicestate.WithWriter(writer()),
+	}
+	if *schema != "" {
+		s, err := servicestate.LoadSchema(*schema)
+		if err != nil {
+			fatal(err)
+		}
+		opts = append(opts, servicestate.WithSchema(s))
+	}
+	if *key_file != "" {
+		opts = append(opts, servicestate.WithKeyFile(*key_file))
+	}
+	for _, pattern := range strings.Split(*histories, ",") {
+		if pattern != "" {
+			opts = append(opts, servicestate.WithHistory(pattern))
+		}
+	}
+
+	ctx := context.Background()
+	store, err := servicestate.NewStore(ctx, *root, "", strings.Split(*etcd_hosts, ","), opts...)
+	if err != nil {
+		fatal(err)
+	}
+	defer store.Close()
+
+	arg := func(i int) string {
+		if i >= len(args) {
+			usage()
+		}
+		return args[i]
+	}
+	prefix := ""
+	if len(args) > 1 {
+		prefix = args[1]
+	}
+
+	switch args[0] {
+	case "get":
+		value, ok := store.Var(arg(1), arg(2))
+		key := args[1] + "/" + args[2]
+		if v, is_rejected := store.Rejected()[key]; is_rejected {
+			warn_rejected(map[string]string{key: v})
+		}
+		if !ok {
+			err = fmt.Errorf("%v/%v not found", args[1], args[2])
+			break
+		}
+		if store.IsSecret(args[1], args[2]) && !*reveal {
+			value = servicestate.REDACTED
+		}
+		fmt.Println(value)
+	case "set":
+		err = store.ValidateAndSet(ctx, arg(1), arg(2), arg(3))
+	case "list":
+		list(store.Subtree(prefix), rejected(store, prefix))
+	case "watch":
+		watch(store, prefix)
+	case "export":
+		warn_rejected(rejected(store, prefix))
+		err = export(os.Stdout, store.Subtree(prefix), *format)
+	case "diff":
+		err = diff_file(store, arg(1))
+	case "import":
+		err = import_file(ctx, store, arg(1))
+	case "history":
+		err = history(ctx, store, args[1:])
+	case "rotate":
+		var n int
+		if n, err = store.RotateSecrets(ctx); err == nil {
+			fmt.Printf("%v secrets rotated\n", n)
+		}
+	default:
+		usage()
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// split a key relative to the root into category and service
+func split(key string) (category, service string) {
+	i := strings.LastIndex(key, "/")
+	return key[:i], key[i+1:]
+}
+
+func sorted_keys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rejected returns the values of etcd held back by the validators at or below
+// prefix, the store serves the previous value of their keys if any
+func rejected(store *servicestate.Store, prefix string) map[string]string {
+	dir := strings.Trim(prefix, "/")
+	values := make(map[string]string)
+	for k, v := range store.Rejected() {
+		if dir == "" || k == dir || strings.HasPrefix(k, dir+"/") {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// warn_rejected tells on stderr which values of etcd are not served
+func warn_rejected(values map[string]string) {
+	for _, k := range sorted_keys(values) {
+		fmt.Fprintf(os.Stderr, "%v rejected by validation, etcd holds %q\n", k, values[k])
+	}
+}
+
+// list prints the served values, then the rejected ones held in etcd
+func list(values, rejected map[string]string) {
+	for _, k := range sorted_keys(values) {
+		category, service := split(k)
+		fmt.Printf("%v\t%v\t%v\n", category, service, values[k])
+	}
+	for _, k := range sorted_keys(rejected) {
+		category, service := split(k)
+		fmt.Printf("%v\t%v\t%v\t(rejected)\n", category, service, rejected[k])
+	}
+}
+
+func watch(store *servicestate.Store, prefix string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	for ev := range store.Subscribe(ctx, prefix) {
+		switch ev.Type {
+		case servicestate.EventResync:
+			fmt.Printf("%v\t%v\n", ev.Revision, ev.Type)
+		case servicestate.EventDelete:
+			fmt.Printf("%v\t%v\t%v\t%q\n", ev.Revision, ev.Type, ev.Key, ev.OldValue)
+		default:
+			fmt.Printf("%v\t%v\t%v\t%q -> %q\n", ev.Revision, ev.Type, ev.Key, ev.OldValue, ev.NewValue)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package servicestate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+)
+
+// grant_ephemeral returns the lease of the ephemeral values, granting it and
+// starting its keepalive on first use, p.ephemeral_mu must be held
+func (p *Store) grant_ephemeral(ctx context.Context) (clientv3.LeaseID, error) {
+	if p.ephemeral_lease != 0 {
+		return p.ephemeral_lease, nil
+	}
+
+	ttl := int64((p.ephemeral_ttl + time.Second - 1) / time.Second)
+	resp, err := p.client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	keepalive, err := p.client.KeepAlive(p.ctx, resp.ID)
+	if err != nil {
+		p.client.Revoke(ctx, resp.ID)
+		return 0, err
+	}
+
+	p.ephemeral_lease = resp.ID
+	p.wg.Add(1)
+	go p.keep_ephemeral(resp.ID, keepalive)
+	return resp.ID, nil
+}
+
+// keep_ephemeral drains the keepalive responses, once the lease is lost the
+// ephemeral values are written again under a new lease
+func (p *Store) keep_ephemeral(id clientv3.LeaseID, keepalive <-chan *clientv3.LeaseKeepAliveResponse) {
+	defer p.wg.Done()
+
+	for range keepalive {
+	}
+
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	log.Warnf("servicestate %v ephemeral lease %x lost", p.root, id)
+	for retry := time.Duration(1); ; retry++ {
+		err := p.restore_ephemeral(id)
+		if err == nil {
+			return
+		}
+
+		log.Errorf("servicestate %v restore ephemeral err %v", p.root, err)
+		if retry > RESYNC_MAX_RETRY {
+			retry = RESYNC_MAX_RETRY
+		}
+
+		select {
+		case <-time.After(retry * RESYNC_INTERVAL):
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// restore_ephemeral rewrites every ephemeral value under a new lease
+func (p *Store) restore_ephemeral(lost clientv3.LeaseID) error {
+	p.ephemeral_mu.Lock()
+	defer p.ephemeral_mu.Unlock()
+
+	if p.ephemeral_lease == lost {
+		p.ephemeral_lease = 0
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+	defer cancel()
+
+	id, err := p.grant_ephemeral(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ops []clientv3.Op
+	for key, value := range p.ephemerals {
+		ops = append(ops, clientv3.OpPut(key, value, clientv3.WithLease(id)))
+	}
+
+	if _, err := p.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+		return err
+	}
+
+	log.Infof("servicestate %v %v ephemeral values restored under lease %x", p.root, len(ops), id)
+	return nil
+}
+
+// revoke_ephemeral removes the ephemeral values on Close
+func (p *Store) revoke_ephemeral() {
+	p.ephemeral_mu.Lock()
+	defer p.ephemeral_mu.Unlock()
+
+	if p.ephemeral_lease == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	if _, err := p.client.Revoke(ctx, p.ephemeral_lease); err != nil {
+		log.Errorf("servicestate %v revoke ephemeral err %v", p.root, err)
+	}
+	p.ephemeral_lease = 0
+}
+
+// UpdateEphemeralVar writes a value that lives as long as this process keeps
+// its lease, it is removed in etcd when the process dies or closes the store
+// and written again when the lease is lost while the process lives on.
+// Ephemeral writes are not recorded in the history. It stays ephemeral until
+// DeleteEphemeralVar or a write or delete of the variable by the store.
+func (p *Store) UpdateEphemeralVar(ctx context.Context, path, key, value string) error {
+	if p.client == nil {
+		return fmt.Errorf("servicestate %v not initialized", p.root)
+	}
+
+	p.ephemeral_mu.Lock()
+	defer p.ephemeral_mu.Unlock()
+
+	id, err := p.grant_ephemeral(ctx)
+	if err != nil {
+		return err
+	}
+
+	full := path_join(p.root, path, key)
+	value, err = p.seal(full, value)
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.client.Put(ctx, full, value, clientv3.WithLease(id)); err != nil {
+		return err
+	}
+
+	p.ephemerals[full] = value
+	return nil
+}
+
+// DeleteEphemeralVar removes an ephemeral value, it is not written again on
+// a new lease
+func (p *Store) DeleteEphemeralVar(ctx context.Context, path, key string) error {
+	if p.client == nil {
+		return fmt.Errorf("servicestate %v not initialized", p.root)
+	}
+
+	p.ephemeral_mu.Lock()
+	defer p.ephemeral_mu.Unlock()
+
+	full := path_join(p.root, path, key)
+	if _, err := p.client.Delete(ctx, full); err != nil {
+		return err
+	}
+
+	delete(p.ephemerals, full)
+	return nil
+}
+
+// forget_ephemeral stops writing again the ephemeral values of keys, which
+// were overwritten or deleted
+func (p *Store) forget_ephemeral(keys ...string) {
+	p.ephemeral_mu.Lock()
+	defer p.ephemeral_mu.Unlock()
+
+	for _, key := range keys {
+		delete(p.ephemerals, key)
+	}
+}
+
+// SetEphemeralVar writes an ephemeral value under path for the store's own service id
+func (p *Store) SetEphemeralVar(ctx context.Context, path, value string) error {
+	return p.UpdateEphemeralVar(ctx, path, p.service_id, value)
+}
+
+func SetEphemeralVar(path, value string) error {
+	return _default_server.SetEphemeralVar(context.Background(), path, value)
+}
+
+func UpdateEphemeralVar(path, key, value string) error {
+	return _default_server.UpdateEphemeralVar(context.Background(), path, key, value)
+}
+
+func DeleteEphemeralVar(path, key string) error {
+	return _default_server.DeleteEphemeralVar(context.Background(), path, key)
+}
@@ -0,0 +1,215 @@
+package servicestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HISTORY_SUFFIX = ".history" // the history of <root> lives under <root>.history
+	HISTORY_LIMIT  = 100        // records kept per variable
+)
+
+// Change is one recorded write of a variable, Revision is the etcd revision
+// the write was committed at
+type Change struct {
+	Revision int64     `json:"-"`
+	Writer   string    `json:"writer"`
+	Time     time.Time `json:"time"`
+	OldValue string    `json:"old"`
+	NewValue string    `json:"new"`
+}
+
+// WithHistory records the writes of the store to the variables whose key or
+// category, relative to the root, matches pattern, see History. The other
+// variables have no history. Every store writing a variable should record it,
+// ValueAt and Rollback refuse the revisions followed by a write not recorded.
+func WithHistory(pattern string) Option {
+	return func(p *Store) {
+		p.histories = append(p.histories, strings.Split(pattern, "/"))
+	}
+}
+
+// is_recorded tells if the writes of the full key are recorded
+func (p *Store) is_recorded(key string) bool {
+	return p.matches(p.histories, key)
+}
+
+func default_writer(service_id string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return service_id
+	}
+
+	return service_id + "@" + hostname
+}
+
+// history_dir is where the records of a full key are kept, outside the root
+// so the watcher does not see them
+func (p *Store) history_dir(key string) string {
+	return p.root + HISTORY_SUFFIX + "/" + strings.TrimPrefix(key, p.root+"/") + "/"
+}
+
+// history_op records a write of key, committed in the same txn as the write
+// so the record shares its revision
+func (p *Store) history_op(key, old, value string) (op clientv3.Op, err error) {
+	now := time.Now()
+	record, err := json.Marshal(Change{Writer: p.writer, Time: now, OldValue: old, NewValue: value})
+	if err != nil {
+		return
+	}
+
+	op = clientv3.OpPut(fmt.Sprintf("%v%020d", p.history_dir(key), now.UnixNano()), string(record))
+	return
+}
+
+// history_kvs returns the records of a full key in commit order
+func (p *Store) history_kvs(ctx context.Context, key string, opts ...clientv3.OpOption) ([]*mvccpb.KeyValue, error) {
+	dir := p.history_dir(key)
+	opts = append(opts, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByModRevision, clientv3.SortAscend))
+	resp, err := p.client.Get(ctx, dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := resp.Kvs[:0]
+	for _, kv := range resp.Kvs {
+		// records of deeper variables share the prefix
+		if !strings.Contains(strings.TrimPrefix(string(kv.Key), dir), "/") {
+			kvs = append(kvs, kv)
+		}
+	}
+
+	return kvs, nil
+}
+
+// prune_history keeps the latest HISTORY_LIMIT records of key, by commit
+// order as the writers' clocks may differ
+func (p *Store) prune_history(ctx context.Context, key string) {
+	kvs, err := p.history_kvs(ctx, key, clientv3.WithKeysOnly())
+	if err != nil {
+		log.Errorf("servicestate prune history %v err %v", key, err)
+		return
+	}
+
+	for i := 0; i < len(kvs)-HISTORY_LIMIT; i++ {
+		if _, err := p.client.Delete(ctx, string(kvs[i].Key)); err != nil {
+			log.Errorf("servicestate prune history %v err %v", key, err)
+			return
+		}
+	}
+}
+
+// history returns the recorded writes of a full key as stored, oldest first
+func (p *Store) history(ctx context.Context, key string) ([]Change, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("servicestate %v not initialized", p.root)
+	}
+
+	kvs, err := p.history_kvs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for _, kv := range kvs {
+		var change Change
+		if err := json.Unmarshal(kv.Value, &change); err != nil {
+			return nil, fmt.Errorf("history %v err %v", string(kv.Key), err)
+		}
+
+		change.Revision = kv.ModRevision
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// History returns the recorded writes of path/key, oldest first, the values
+// of secrets are redacted. Only the variables of WithHistory are recorded.
+func (p *Store) History(ctx context.Context, path, key string) ([]Change, error) {
+	full := path_join(p.root, path, key)
+	changes, err := p.history(ctx, full)
+	for i := range changes {
+		changes[i].OldValue = p.redact(full, changes[i].OldValue)
+		changes[i].NewValue = p.redact(full, changes[i].NewValue)
+	}
+
+	return changes, err
+}
+
+// ValueAt returns the value path/key held at revision according to its
+// history, secrets decrypted. It fails if a write that is not recorded, by a
+// store without WithHistory for path/key, followed that revision's record.
+func (p *Store) ValueAt(ctx context.Context, path, key string, revision int64) (string, error) {
+	full := path_join(p.root, path, key)
+	changes, err := p.history(ctx, full)
+	if err != nil {
+		return "", err
+	}
+
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].Revision > revision {
+			continue
+		}
+
+		// a writer without WithHistory leaves the value after this record unknown
+		if err := p.recorded_after(ctx, full, changes, i); err != nil {
+			return "", fmt.Errorf("%v/%v at revision %v: %v", path, key, revision, err)
+		}
+
+		return p.reveal(full, changes[i].NewValue, LAYER_ETCD)
+	}
+
+	return "", fmt.Errorf("%v/%v has no history at revision %v", path, key, revision)
+}
+
+// recorded_after checks that the next write of key after changes[i] is
+// recorded: the next record starts from the value of changes[i], or key is
+// still as changes[i] wrote it
+func (p *Store) recorded_after(ctx context.Context, key string, changes []Change, i int) error {
+	if i+1 < len(changes) {
+		if changes[i+1].OldValue != changes[i].NewValue {
+			return fmt.Errorf("written without history after revision %v", changes[i].Revision)
+		}
+		return nil
+	}
+
+	resp, err := p.client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Kvs) == 0 || resp.Kvs[0].ModRevision != changes[i].Revision {
+		return fmt.Errorf("written without history after revision %v", changes[i].Revision)
+	}
+
+	return nil
+}
+
+// Rollback writes back the value path/key held at revision, the rollback is
+// itself recorded in the history
+func (p *Store) Rollback(ctx context.Context, path, key string, revision int64) error {
+	value, err := p.ValueAt(ctx, path, key, revision)
+	if err != nil {
+		return err
+	}
+
+	return p.UpdateGlobalVar(ctx, path, key, value)
+}
+
+func History(path, key string) ([]Change, error) {
+	return _default_server.History(context.Background(), path, key)
+}
+
+func Rollback(path, key string, revision int64) error {
+	return _default_server.Rollback(context.Background(), path, key, revision)
+}
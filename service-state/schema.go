@@ -0,0 +1,132 @@
+package servicestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Rule declares the checks of the variables matching Pattern,
+// see Store.RegisterValidator for how patterns match
+type Rule struct {
+	Pattern string   `json:"pattern"`
+	Type    string   `json:"type,omitempty"` // "int" or "string"
+	Min     *int     `json:"min,omitempty"`
+	Max     *int     `json:"max,omitempty"`
+	Regexp  string   `json:"regexp,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+	Secret  bool     `json:"secret,omitempty"` // see WithSecret
+}
+
+// Schema is a declarative set of validators shared by services and tools,
+// so that writers refuse what the services would reject
+type Schema struct {
+	Rules []Rule `json:"rules"`
+}
+
+// LoadSchema reads a schema from a .json, .yaml or .yml file
+func LoadSchema(file string) (*Schema, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{}
+	switch filepath.Ext(file) {
+	case ".json":
+		err = json.Unmarshal(bytes, schema)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(bytes, schema)
+	default:
+		err = fmt.Errorf("unknown schema format %v", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range schema.Rules {
+		if _, err := r.validator(); err != nil {
+			return nil, fmt.Errorf("schema %v rule %v err %v", file, r.Pattern, err)
+		}
+	}
+
+	return schema, nil
+}
+
+func (r Rule) validator() (Validator, error) {
+	var validators []Validator
+	switch r.Type {
+	case "", "string":
+	case "int":
+		validators = append(validators, func(key, value string) error {
+			_, err := strconv.Atoi(value)
+			return err
+		})
+	default:
+		return nil, fmt.Errorf("unknown type %v", r.Type)
+	}
+
+	if r.Min != nil || r.Max != nil {
+		max := int(^uint(0) >> 1)
+		min := -max - 1
+		if r.Min != nil {
+			min = *r.Min
+		}
+		if r.Max != nil {
+			max = *r.Max
+		}
+		validators = append(validators, IntRange(min, max))
+	}
+
+	if r.Regexp != "" {
+		if _, err := regexp.Compile(r.Regexp); err != nil {
+			return nil, err
+		}
+		validators = append(validators, MatchRegexp(r.Regexp))
+	}
+
+	if len(r.Enum) > 0 {
+		validators = append(validators, func(key, value string) error {
+			for _, v := range r.Enum {
+				if v == value {
+					return nil
+				}
+			}
+
+			return fmt.Errorf("not one of %v", r.Enum)
+		})
+	}
+
+	return func(key, value string) error {
+		for _, v := range validators {
+			if err := v(key, value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// WithSchema registers the validators and secrets of every rule before the
+// initial load
+func WithSchema(schema *Schema) Option {
+	return func(p *Store) {
+		for _, r := range schema.Rules {
+			v, err := r.validator()
+			if err != nil {
+				panic(fmt.Sprintf("schema rule %v err %v", r.Pattern, err))
+			}
+
+			WithValidator(r.Pattern, v)(p)
+			if r.Secret {
+				WithSecret(r.Pattern)(p)
+			}
+		}
+	}
+}
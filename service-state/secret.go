@@ -0,0 +1,397 @@
+package servicestate
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	SECRET_PREFIX   = "enc:v1:" // enc:v1:<key id>:<base64 nonce|ciphertext>
+	SECRET_KEY_SIZE = 32        // AES-256
+	REDACTED        = "******"  // shown in place of secret values
+)
+
+// keyring holds the AES keys of a key file, one "<id> <base64 key>" per line,
+// the last key is the primary one new values are encrypted with and the
+// older ones stay to decrypt values written before a rotation
+type keyring struct {
+	file    string
+	primary string
+	keys    map[string][]byte
+	mu      sync.RWMutex
+}
+
+func load_keyring(file string) (*keyring, error) {
+	k := &keyring{file: file}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *keyring) reload() error {
+	f, err := os.Open(k.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var primary string
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return fmt.Errorf("key file %v line %v malformed", k.file, n)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != SECRET_KEY_SIZE {
+			return fmt.Errorf("key file %v line %v: not a base64 %v bytes key", k.file, n, SECRET_KEY_SIZE)
+		}
+
+		keys[fields[0]] = key
+		primary = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if primary == "" {
+		return fmt.Errorf("key file %v has no key", k.file)
+	}
+
+	k.mu.Lock()
+	k.primary, k.keys = primary, keys
+	k.mu.Unlock()
+	return nil
+}
+
+func (k *keyring) get(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+func (k *keyring) primary_id() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+func new_gcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts value with the primary key, name is authenticated along so a
+// ciphertext cannot be moved to another variable
+func (k *keyring) seal(name, value string) (string, error) {
+	id := k.primary_id()
+	key, _ := k.get(id)
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(name))
+	return SECRET_PREFIX + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a sealed value, the key file is read again once when the
+// key id is unknown, e.g. after a rotation by another process
+func (k *keyring) open(name, value string) (string, error) {
+	id, data, err := secret_parts(value)
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := k.get(id)
+	if !ok {
+		if err := k.reload(); err != nil {
+			return "", err
+		}
+
+		if key, ok = k.get(id); !ok {
+			return "", fmt.Errorf("unknown key %v", id)
+		}
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := new_gcm(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("secret too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// secret_parts splits a sealed value into its key id and encoded ciphertext
+func secret_parts(value string) (id, data string, err error) {
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		err = fmt.Errorf("value not encrypted")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, SECRET_PREFIX), ":", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("malformed secret")
+		return
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// GenerateKey appends a new random key named id to the key file, creating it,
+// the new key becomes the primary one, see Store.RotateSecrets
+func GenerateKey(file, id string) error {
+	if id == "" || strings.ContainsAny(id, ": \t#") {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+
+	if _, err := os.Stat(file); err == nil {
+		k, err := load_keyring(file)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := k.get(id); ok {
+			return fmt.Errorf("key %v exists in %v", id, file)
+		}
+	}
+
+	key := make([]byte, SECRET_KEY_SIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(f, "%v %v\n", id, base64.StdEncoding.EncodeToString(key)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// WithKeyFile encrypts and decrypts the secret variables with the keys of
+// file, see GenerateKey
+func WithKeyFile(file string) Option {
+	return func(p *Store) {
+		p.key_file = file
+	}
+}
+
+// WithSecret marks the variables whose key or category, relative to the root,
+// matches pattern as secret. Secrets are written encrypted, kept decrypted in
+// memory only and redacted in logs, events, Subtree, Glob, Rejected and History.
+func WithSecret(pattern string) Option {
+	return func(p *Store) {
+		p.secrets = append(p.secrets, strings.Split(pattern, "/"))
+	}
+}
+
+// is_secret tells if the full key is a secret variable, the patterns are only
+// set before the initial load so no lock is needed
+func (p *Store) is_secret(key string) bool {
+	return p.matches(p.secrets, key)
+}
+
+// matches tells if the key or category of the full key, relative to the
+// root, matches one of patterns
+func (p *Store) matches(patterns [][]string, key string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	category, _, err := p.path(key)
+	if err != nil {
+		return false
+	}
+
+	rel := strings.Split(strings.TrimPrefix(key, p.root+"/"), "/")
+	categories := strings.Split(category, "/")
+	for _, pattern := range patterns {
+		if glob_match(pattern, rel) || glob_match(pattern, categories) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redact hides the value of a secret key
+func (p *Store) redact(key, value string) string {
+	if value == "" || !p.is_secret(key) {
+		return value
+	}
+
+	return REDACTED
+}
+
+// seal encrypts the value written to a secret key
+func (p *Store) seal(key, value string) (string, error) {
+	if !p.is_secret(key) {
+		return value, nil
+	}
+
+	if p.keys == nil {
+		return "", fmt.Errorf("%v is secret, no key file", strings.TrimPrefix(key, p.root+"/"))
+	}
+
+	return p.keys.seal(strings.TrimPrefix(key, p.root+"/"), value)
+}
+
+// reveal decrypts the value of a secret key, values of etcd must be
+// encrypted while the local layers may hold plaintext
+func (p *Store) reveal(key, value, layer string) (string, error) {
+	if !p.is_secret(key) {
+		return value, nil
+	}
+
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		if layer == LAYER_ETCD {
+			return "", fmt.Errorf("secret stored in plaintext")
+		}
+		return value, nil
+	}
+
+	if p.keys == nil {
+		return "", fmt.Errorf("secret without key file")
+	}
+
+	return p.keys.open(strings.TrimPrefix(key, p.root+"/"), value)
+}
+
+// IsSecret tells if path/key is a secret variable
+func (p *Store) IsSecret(path, key string) bool {
+	return p.is_secret(path_join(p.root, path, key))
+}
+
+// RotateSecrets reads the key file again and re-encrypts with its primary key
+// the secrets written with older keys, it returns how many were rewritten.
+// Every service must have the new key file before the rotation, the old keys
+// can be removed from it afterwards.
+func (p *Store) RotateSecrets(ctx context.Context) (int, error) {
+	if p.client == nil {
+		return 0, fmt.Errorf("servicestate %v not initialized", p.root)
+	}
+
+	if p.keys == nil {
+		return 0, fmt.Errorf("servicestate %v no key file", p.root)
+	}
+
+	if err := p.keys.reload(); err != nil {
+		return 0, err
+	}
+	primary := p.keys.primary_id()
+
+	resp, err := p.client.Get(ctx, p.root+"/", clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, kv := range resp.Kvs {
+		key, value := string(kv.Key), string(kv.Value)
+		if !p.is_secret(key) {
+			continue
+		}
+
+		id, _, err := secret_parts(value)
+		if err != nil || id == primary {
+			continue
+		}
+
+		plain, err := p.keys.open(strings.TrimPrefix(key, p.root+"/"), value)
+		if err != nil {
+			log.Errorf("servicestate rotate %v err %v", key, err)
+			continue
+		}
+
+		sealed, err := p.keys.seal(strings.TrimPrefix(key, p.root+"/"), plain)
+		if err != nil {
+			return rotated, err
+		}
+
+		ops := []clientv3.Op{clientv3.OpPut(key, sealed)}
+		recorded := p.is_recorded(key)
+		if recorded {
+			record, err := p.history_op(key, value, sealed)
+			if err != nil {
+				return rotated, err
+			}
+			ops = append(ops, record)
+		}
+
+		// a concurrent writer already replaced the value with the current key
+		txn, err := p.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+			Then(ops...).Commit()
+		if err != nil {
+			return rotated, err
+		}
+
+		if txn.Succeeded {
+			if recorded {
+				p.prune_history(ctx, key)
+			}
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+func IsSecret(path, key string) bool {
+	return _default_server.IsSecret(path, key)
+}
+
+func RotateSecrets() (int, error) {
+	return _default_server.RotateSecrets(context.Background())
+}
@@ -1,84 +1,263 @@
 package servicestate
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	etcdclient "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/context"
 )
 
 const (
 	NUMBER_PREFIX_NODE = "number_prefixs"
+	DEFAULT_TIMEOUT    = 5 * time.Second
+	RESYNC_INTERVAL    = time.Second // backoff step between resync attempts
+	RESYNC_MAX_RETRY   = 10
+	CACHE_INTERVAL     = 10 * time.Second // how often watched changes are written to the cache file
+	UPDATE_MAX_RETRY   = 10               // attempts of a write racing with other writers
+	EPHEMERAL_TTL      = 10 * time.Second // lease of ephemeral values
 )
 
 var (
 	once            sync.Once
-	_default_server server
+	_default_server = &Store{}
 )
 
-func Init(root_path, service_id string, etcd_hosts []string) {
+// Init() the default store used by the package level functions
+func Init(root_path, service_id string, etcd_hosts []string, opts ...Option) {
 	once.Do(func() {
-		_default_server.init(root_path, service_id, etcd_hosts)
+		if err := _default_server.init(context.Background(), root_path, service_id, etcd_hosts, opts...); err != nil {
+			log.Panic(err)
+		}
 	})
 }
 
-func path_join(params ...string) string {
-	return strings.Join(params, "/")
+// Default returns the store behind the package level functions
+func Default() *Store {
+	return _default_server
 }
 
-func path_dir(path string) string {
-	dir := filepath.Dir(path)
-	return strings.ReplaceAll(dir, "\\", "/")
+func path_join(params ...string) string {
+	return strings.Join(params, "/")
 }
 
-type server struct {
+// Store keeps the variables under one root in memory and follows etcd changes,
+// several stores with different roots can live in one process
+type Store struct {
 	root           string
 	service_id     string
-	client         etcdclient.Client
+	client         *clientv3.Client
+	revision       int64 // etcd revision the local state is consistent with
 	number_prefixs map[string]bool
 	number_datas   map[string]map[string]int
+	number_stats   map[string]*group_stats // aggregates of number_datas
 	string_datas   map[string]map[string]string
 	pathdatas      map[string]string
-	callbacks      map[string][]chan string // callback on change
+	pathrevisions  map[string]int64  // mod revision of every value
+	origins        map[string]string // layer of every value
+	layers         map[string]map[string]layer_value
+	precedence     []string // layers, highest first
+	sources        []Source
+	subscriptions  map[*subscription]bool // change streams
+	stale          bool                   // not in sync with etcd
+	validators     []validator
+	rejected       map[string]rejection // values held back by validation
+	statter        Statter
 	mu             sync.RWMutex
+
+	timeout        time.Duration // bound of each etcd request
+	cache_file     string        // local snapshot for offline startup
+	cache_revision int64         // revision written to cache_file
+	writer         string        // recorded in the history of writes
+	ephemeral_ttl  time.Duration // lease ttl of ephemeral values
+
+	ephemeral_lease clientv3.LeaseID  // 0 until the first ephemeral value
+	ephemerals      map[string]string // ephemeral values to rewrite on a new lease
+	ephemeral_mu    sync.Mutex
+
+	key_file string     // keys of the secret variables
+	keys     *keyring   // nil without key file
+	secrets  [][]string // patterns of the secret variables
+
+	histories [][]string // patterns of the variables with a history
+
+	ctx    context.Context // cancelled by Close
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Option configures a Store
+type Option func(*Store)
+
+// WithTimeout bounds every etcd request of the store, DEFAULT_TIMEOUT by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *Store) {
+		p.timeout = timeout
+	}
+}
+
+// WithCacheFile keeps a local snapshot in file, the store starts from it
+// rather than empty when etcd is unreachable at startup
+func WithCacheFile(file string) Option {
+	return func(p *Store) {
+		p.cache_file = file
+	}
+}
+
+// WithStatter sends the store's metrics to statter, a g2s.Statter fits
+func WithStatter(statter Statter) Option {
+	return func(p *Store) {
+		p.statter = statter
+	}
+}
+
+// WithNumberPrefixs sets the number categories as the number_prefixs key
+// of etcd does, for the stores without etcd. The categories of etcd are added.
+func WithNumberPrefixs(prefixs ...string) Option {
+	return func(p *Store) {
+		if p.number_prefixs == nil {
+			p.number_prefixs = make(map[string]bool)
+		}
+		for _, prefix := range prefixs {
+			p.number_prefixs[prefix] = true
+		}
+	}
+}
+
+// WithValidator registers a validator before the initial load,
+// see Store.RegisterValidator
+func WithValidator(pattern string, v Validator) Option {
+	return func(p *Store) {
+		p.validators = append(p.validators, validator{pattern: strings.Split(pattern, "/"), f: v})
+	}
+}
+
+// WithEphemeralTTL sets how long ephemeral values outlive a dead process,
+// EPHEMERAL_TTL by default
+func WithEphemeralTTL(ttl time.Duration) Option {
+	return func(p *Store) {
+		p.ephemeral_ttl = ttl
+	}
+}
+
+// WithWriter names the writer recorded in the history, service_id@hostname by default
+func WithWriter(writer string) Option {
+	return func(p *Store) {
+		p.writer = writer
+	}
 }
 
-func (p *server) init(root_path, service_id string, etcd_hosts []string) {
+// NewStore loads the variables under root_path and starts following changes,
+// ctx bounds the initial load only, call Close to stop the store. When etcd is
+// unreachable the store starts stale, from the cache file if any, and catches
+// up in the background, only a bad configuration is an error.
+func NewStore(ctx context.Context, root_path, service_id string, etcd_hosts []string, opts ...Option) (*Store, error) {
+	p := &Store{}
+	if err := p.init(ctx, root_path, service_id, etcd_hosts, opts...); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Store) init(ctx context.Context, root_path, service_id string, etcd_hosts []string, opts ...Option) error {
 	p.root = root_path
 	p.service_id = service_id
+	p.timeout = DEFAULT_TIMEOUT
+	p.statter = noop_statter{}
+	p.writer = default_writer(service_id)
+	p.ephemeral_ttl = EPHEMERAL_TTL
+	p.ephemerals = make(map[string]string)
+	p.precedence = []string{LAYER_ETCD, LAYER_ENV, LAYER_FILE, LAYER_DEFAULT}
+	for _, opt := range opts {
+		opt(p)
+	}
 
-	p.number_prefixs = make(map[string]bool)
+	if p.number_prefixs == nil {
+		p.number_prefixs = make(map[string]bool)
+	}
 	p.number_datas = make(map[string]map[string]int)
+	p.number_stats = make(map[string]*group_stats)
 	p.string_datas = make(map[string]map[string]string)
 	p.pathdatas = make(map[string]string)
-	p.callbacks = make(map[string][]chan string)
+	p.pathrevisions = make(map[string]int64)
+	p.origins = make(map[string]string)
+	p.layers = make(map[string]map[string]layer_value)
+	p.subscriptions = make(map[*subscription]bool)
+	p.rejected = make(map[string]rejection)
+	if p.key_file != "" {
+		keys, err := load_keyring(p.key_file)
+		if err != nil {
+			return err
+		}
+		p.keys = keys
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
-	cfg := etcdclient.Config{
+	if err := p.load_sources(); err != nil {
+		return err
+	}
+
+	// local layers only
+	if len(etcd_hosts) == 0 {
+		return nil
+	}
+
+	// connects in the background, so an unreachable etcd is not an error here
+	cfg := clientv3.Config{
 		Endpoints: etcd_hosts,
-		Transport: etcdclient.DefaultTransport,
 	}
 
-	c, err := etcdclient.New(cfg)
+	c, err := clientv3.New(cfg)
 	if err != nil {
-		log.Panic(err)
-		os.Exit(-1)
+		return err
 	}
 
 	p.client = c
 
-	p.load_number_prefixs(path_join(p.root, NUMBER_PREFIX_NODE))
+	// etcd unreachable is not an error, the watcher resyncs in the background
+	if err := p.load(ctx); err != nil {
+		p.set_stale(true)
+		switch {
+		case p.cache_file == "":
+			log.Warnf("servicestate %v load err %v, started empty", p.root, err)
+		default:
+			if cache_err := p.load_cache(); cache_err != nil {
+				log.Warnf("servicestate %v load err %v, cache %v, started empty", p.root, err, cache_err)
+				break
+			}
+
+			log.Warnf("servicestate %v load err %v, started from %v at revision %v", p.root, err, p.cache_file, p.get_revision())
+		}
+	}
+
+	p.wg.Add(1)
+	go p.watcher()
+	return nil
+}
+
+// Close stops following etcd, the values loaded so far stay readable
+func (p *Store) Close() error {
+	if p.cancel == nil {
+		return nil
+	}
+
+	p.cancel()
+	p.wg.Wait()
+	if p.client == nil {
+		return nil
+	}
 
-	//
-	p.load()
+	p.revoke_ephemeral()
+	return p.client.Close()
 }
 
-func (p *server) is_number_type(name string) bool {
+func (p *Store) is_number_type(name string) bool {
 	for k := range p.number_prefixs {
 		if strings.HasPrefix(name, k) {
 			return true
@@ -88,26 +267,38 @@ func (p *server) is_number_type(name string) bool {
 	return false
 }
 
-func (p *server) path(key string) (category, service string, err error) {
-	var seperator string = "/"
-	if strings.Contains(key, "\\") {
-		seperator = "\\"
+// path splits a key below the root into its category, which may span several
+// levels, and the service as the last level
+func (p *Store) path(key string) (category, service string, err error) {
+	key = strings.ReplaceAll(key, "\\", "/")
+	if !strings.HasPrefix(key, p.root+"/") {
+		err = fmt.Errorf("%v not under %v", key, p.root)
+		return
 	}
 
-	params := strings.Split(key, seperator)
-	if len(params) != 4 {
-		err = fmt.Errorf("Split %v len not equal 4", key)
+	params := strings.Split(strings.TrimPrefix(key, p.root+"/"), "/")
+	if len(params) < 2 {
+		err = fmt.Errorf("Split %v len less than 2", key)
 		return
 	}
 
-	category = params[2]
-	service = params[3]
+	category = path_join(params[:len(params)-1]...)
+	service = params[len(params)-1]
 	return
 }
 
-func (p *server) set(key, value string) {
-	category, service, err := p.path(key)
-	if err != nil {
+// set records a value of the etcd layer, see resolve
+func (p *Store) set(key, value string, revision int64) {
+	p.set_layer(LAYER_ETCD, key, value, revision)
+}
+
+// remove drops a value of the etcd layer, see resolve
+func (p *Store) remove(key string, revision int64) {
+	p.remove_layer(LAYER_ETCD, key, revision)
+}
+
+func (p *Store) set_layer(layer, key, value string, revision int64) {
+	if _, _, err := p.path(key); err != nil {
 		log.Error(err)
 		return
 	}
@@ -115,18 +306,76 @@ func (p *server) set(key, value string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	p.pathdatas[key] = value
-	if ok := p.is_number_type(category); ok {
-		num, err := strconv.Atoi(value)
-		if err != nil {
-			log.Errorf("Set %v = %v strconv.Atoi err %v", key, value, err)
+	if _, ok := p.layers[layer]; !ok {
+		p.layers[layer] = make(map[string]layer_value)
+	}
+	p.layers[layer][key] = layer_value{value: value, revision: revision}
+	p.resolve(key, revision)
+}
+
+func (p *Store) remove_layer(layer, key string, revision int64) {
+	if _, _, err := p.path(key); err != nil {
+		log.Error(err)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.layers[layer], key)
+	p.resolve(key, revision)
+}
+
+// resolve applies the value of key from the layer with the highest precedence,
+// or removes key when no layer has it, p.mu must be held
+func (p *Store) resolve(key string, revision int64) {
+	for _, layer := range p.precedence {
+		v, ok := p.layers[layer][key]
+		if !ok {
+			continue
+		}
+
+		if old, ok := p.pathdatas[key]; ok && old == v.value && p.pathrevisions[key] == v.revision && p.origins[key] == layer {
 			return
 		}
 
+		p.apply(key, v.value, v.revision, layer)
+		return
+	}
+
+	p.unapply(key, revision)
+}
+
+// apply makes value the effective value of key, p.mu must be held
+func (p *Store) apply(key, value string, revision int64, layer string) {
+	category, service, _ := p.path(key)
+
+	// secrets are decrypted here and kept in plaintext in memory only
+	raw := value
+	value, err := p.reveal(key, value, layer)
+	if err != nil {
+		p.reject(key, raw, revision, err)
+		return
+	}
+
+	// a value failing validation is not applied, the previous one stays
+	if err := p.validate(key, category, value); err != nil {
+		p.reject(key, raw, revision, err)
+		return
+	}
+	p.unreject(key)
+
+	old := p.pathdatas[key]
+	p.pathdatas[key] = value
+	p.pathrevisions[key] = revision
+	p.origins[key] = layer
+	if ok := p.is_number_type(category); ok {
+		num, _ := strconv.Atoi(value)
 		if _, ok := p.number_datas[category]; !ok {
 			p.number_datas[category] = make(map[string]int)
 		}
 
+		p.stats_set(category, service, num)
 		p.number_datas[category][service] = num
 	} else {
 		if _, ok := p.string_datas[category]; !ok {
@@ -136,48 +385,37 @@ func (p *server) set(key, value string) {
 		p.string_datas[category][service] = value
 	}
 
-	callback_path := path_dir(key)
-	for k := range p.callbacks[callback_path] {
-		select {
-		case p.callbacks[callback_path][k] <- key:
-		default:
-		}
-	}
+	p.publish(Event{Type: EventSet, Key: key, OldValue: old, NewValue: value, Revision: revision})
 }
 
-func (p *server) remove(key string) {
-	category, service, err := p.path(key)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// unapply removes the effective value of key, p.mu must be held
+func (p *Store) unapply(key string, revision int64) {
+	category, service, _ := p.path(key)
 
 	if ok := p.is_number_type(category); ok {
 		if _, ok := p.number_datas[category]; ok {
+			p.stats_remove(category, service)
 			delete(p.number_datas[category], service)
 		}
 	} else {
 		if _, ok := p.string_datas[category]; ok {
-			delete(p.number_datas[category], service)
+			delete(p.string_datas[category], service)
 		}
 	}
+	p.unreject(key)
+	old, ok := p.pathdatas[key]
 	delete(p.pathdatas, key)
+	delete(p.pathrevisions, key)
+	delete(p.origins, key)
 
-	callback_path := path_dir(key)
-	for k := range p.callbacks[callback_path] {
-		select {
-		case p.callbacks[callback_path][k] <- key:
-		default:
-		}
+	if ok {
+		p.publish(Event{Type: EventDelete, Key: key, OldValue: old, Revision: revision})
 	}
 }
 
-func (p *server) get_int(category, service string) (value int) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *Store) get_int(category, service string) (value int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
 	if ok := p.is_number_type(category); ok {
 		if _, ok := p.number_datas[category]; ok {
@@ -189,9 +427,9 @@ func (p *server) get_int(category, service string) (value int) {
 	return -1
 }
 
-func (p *server) get_str(category, service string) (value string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+func (p *Store) get_str(category, service string) (value string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
 	if ok := p.is_number_type(category); !ok {
 		if _, ok := p.string_datas[category]; ok {
@@ -203,7 +441,7 @@ func (p *server) get_str(category, service string) (value string) {
 	return
 }
 
-func (p *server) exec_group_int(category string, f func(map[string]int)) {
+func (p *Store) exec_group_int(category string, f func(map[string]int)) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -217,7 +455,7 @@ func (p *server) exec_group_int(category string, f func(map[string]int)) {
 	return
 }
 
-func (p *server) exec_group_str(category string, f func(map[string]string)) {
+func (p *Store) exec_group_str(category string, f func(map[string]string)) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -231,138 +469,358 @@ func (p *server) exec_group_str(category string, f func(map[string]string)) {
 	return
 }
 
-func (p *server) update(key, value string) (err error) {
-	kAPI := etcdclient.NewKeysAPI(p.client)
+// update writes value together with its history record if key has one, the
+// compare on the previous revision keeps the recorded old value exact under
+// concurrent writers
+func (p *Store) update(ctx context.Context, key, value string) error {
+	if p.client == nil {
+		return fmt.Errorf("servicestate %v not initialized", key)
+	}
 
-	var resp *etcdclient.Response
-	resp, err = kAPI.Get(context.Background(), key, nil)
+	value, err := p.seal(key, value)
 	if err != nil {
-		_, err = kAPI.Create(context.Background(), key, value)
-		return
+		return err
 	}
 
-	if value == resp.Node.Value {
-		return fmt.Errorf("update %v, %v duplicated", key, value)
+	if !p.is_recorded(key) {
+		if _, err = p.client.Put(ctx, key, value); err != nil {
+			return err
+		}
+
+		p.forget_ephemeral(key)
+		return nil
 	}
 
-	prevIndex := resp.Node.ModifiedIndex
-	_, err = kAPI.Set(context.Background(), key, value, &etcdclient.SetOptions{PrevIndex: prevIndex})
-	return
-}
+	for retry := 0; retry < UPDATE_MAX_RETRY; retry++ {
+		resp, err := p.client.Get(ctx, key)
+		if err != nil {
+			return err
+		}
 
-func (p *server) load_number_prefixs(filepath string) {
-	kAPI := etcdclient.NewKeysAPI(p.client)
+		var old string
+		cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		if len(resp.Kvs) > 0 {
+			old = string(resp.Kvs[0].Value)
+			cmp = clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)
+		}
 
-	// get the keys under directory
-	log.Infof("reading number types from:%v", filepath)
-	resp, err := kAPI.Get(context.Background(), filepath, nil)
-	if err != nil {
-		log.Error(err)
-		return
-	}
+		record, err := p.history_op(key, old, value)
+		if err != nil {
+			return err
+		}
 
-	// validation check
-	if resp.Node.Dir {
-		log.Error("types is not a node")
-		return
+		txn, err := p.client.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, value), record).Commit()
+		if err != nil {
+			return err
+		}
+
+		if txn.Succeeded {
+			p.forget_ephemeral(key)
+			p.prune_history(ctx, key)
+			return nil
+		}
 	}
 
+	return fmt.Errorf("update %v modified concurrently", key)
+}
+
+func (p *Store) var_revision(key string) int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pathrevisions[key]
+}
+
+func (p *Store) load_number_prefixs(value string) {
 	// split types
-	types := strings.Split(resp.Node.Value, " ")
+	types := strings.Split(value, " ")
 	for _, v := range types {
-		p.number_prefixs[v] = true
+		if v != "" {
+			p.number_prefixs[v] = true
+		}
 	}
 
-	log.Infof("reading number types :%v", resp.Node.Value)
+	log.Infof("reading number types :%v", value)
 }
 
-func (p *server) load() {
-	kAPI := etcdclient.NewKeysAPI(p.client)
+// load takes a snapshot of the root, replaces the local state with it and
+// remembers the snapshot revision so the watcher can continue right after it
+func (p *Store) load(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
 
-	resp, err := kAPI.Get(context.Background(), p.root, &etcdclient.GetOptions{Recursive: true})
+	resp, err := p.client.Get(ctx, p.root+"/", clientv3.WithPrefix())
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
-	if !resp.Node.Dir {
-		return
+	number_prefixs := path_join(p.root, NUMBER_PREFIX_NODE)
+	snapshot := make(map[string]*mvccpb.KeyValue)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if key == number_prefixs {
+			p.mu.Lock()
+			p.load_number_prefixs(string(kv.Value))
+			p.mu.Unlock()
+			continue
+		}
+
+		snapshot[key] = kv
 	}
 
-	for _, node := range resp.Node.Nodes {
-		if node.Dir {
-			for _, v := range node.Nodes {
-				p.set(v.Key, v.Value)
-			}
+	// drop what disappeared while we were not watching
+	p.mu.RLock()
+	var removed []string
+	for key := range p.layers[LAYER_ETCD] {
+		if _, ok := snapshot[key]; !ok {
+			removed = append(removed, key)
 		}
 	}
+	p.mu.RUnlock()
 
-	go p.watcher()
-}
+	for _, key := range removed {
+		p.remove(key, resp.Header.Revision)
+	}
 
-func (p *server) watcher() {
-	kAPI := etcdclient.NewKeysAPI(p.client)
-	w := kAPI.Watcher(p.root, &etcdclient.WatcherOptions{Recursive: true})
-	for {
-		resp, err := w.Next(context.Background())
-		if err != nil {
-			log.Error(err)
+	for key, kv := range snapshot {
+		p.mu.RLock()
+		v, ok := p.layers[LAYER_ETCD][key]
+		rejected, is_rejected := p.rejected[key]
+		p.mu.RUnlock()
+		if ok && v.revision == kv.ModRevision || is_rejected && rejected.revision == kv.ModRevision {
 			continue
 		}
 
-		if resp.Node.Dir {
-			continue
-		}
+		p.set(key, string(kv.Value), kv.ModRevision)
+	}
 
-		switch resp.Action {
-		case "set", "create", "update", "compareAndSwap":
-			p.set(resp.Node.Key, resp.Node.Value)
-		case "delete":
-			p.remove(resp.PrevNode.Key)
-		}
+	p.set_revision(resp.Header.Revision)
+	p.set_stale(false)
+	log.Infof("servicestate %v loaded at revision %v", p.root, resp.Header.Revision)
+
+	p.save_cache()
+	return nil
+}
+
+func (p *Store) set_revision(revision int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if revision > p.revision {
+		p.revision = revision
 	}
 }
 
-func (p *server) register_callback(path string, callback chan string) {
+func (p *Store) set_stale(stale bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.callbacks[path] = append(p.callbacks[path], callback)
+	p.stale = stale
+}
+
+func (p *Store) is_stale() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stale
+}
 
-	for k := range p.pathdatas {
-		callback_path := path_dir(k)
-		if callback_path != path {
+func (p *Store) get_revision() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.revision
+}
+
+// watcher follows the root from the snapshot revision, a compacted or broken
+// watch is recovered by taking a new snapshot
+func (p *Store) watcher() {
+	defer p.wg.Done()
+
+	for {
+		if !p.is_stale() {
+			p.watch()
+			p.set_stale(true)
+		}
+
+		// resync until the store is closed
+		for retry := time.Duration(1); ; retry++ {
+			if p.ctx.Err() != nil {
+				return
+			}
+
+			err := p.load(p.ctx)
+			if err == nil {
+				break
+			}
+
+			log.Errorf("servicestate %v resync err %v", p.root, err)
+			if retry > RESYNC_MAX_RETRY {
+				retry = RESYNC_MAX_RETRY
+			}
+
+			select {
+			case <-time.After(retry * RESYNC_INTERVAL):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (p *Store) watch() {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(p.ctx))
+	defer cancel()
+
+	ticker := time.NewTicker(CACHE_INTERVAL)
+	defer ticker.Stop()
+
+	channel := p.client.Watch(ctx, p.root+"/", clientv3.WithPrefix(), clientv3.WithRev(p.get_revision()+1))
+	for {
+		var resp clientv3.WatchResponse
+		var ok bool
+		select {
+		case resp, ok = <-channel:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			p.save_cache()
 			continue
 		}
 
-		callback <- k
+		if err := resp.Err(); err != nil {
+			log.Errorf("servicestate %v watch err %v", p.root, err)
+			return
+		}
+
+		for _, ev := range resp.Events {
+			key := string(ev.Kv.Key)
+			if key == path_join(p.root, NUMBER_PREFIX_NODE) {
+				continue
+			}
+
+			switch ev.Type {
+			case mvccpb.PUT:
+				p.set(key, string(ev.Kv.Value), ev.Kv.ModRevision)
+			case mvccpb.DELETE:
+				p.remove(key, ev.Kv.ModRevision)
+			}
+		}
+
+		p.set_revision(resp.Header.Revision)
 	}
+}
+
+// register_callback forwards the keys of a subscription, a slow callback
+// only holds up its own forwarding goroutine
+func (p *Store) register_callback(path string, callback chan string) {
+	events := p.subscribe(p.ctx, path)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for ev := range events {
+			if ev.Type == EventResync || ev.Type == EventRejected {
+				continue
+			}
+
+			select {
+			case callback <- path_join(p.root, ev.Key):
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
 	log.Infof("register callback on: %v", path)
 }
 
+// Revision returns the etcd revision the local values are consistent with,
+// compare it with a write's revision to tell whether the store has seen it
+func (p *Store) Revision() int64 {
+	return p.get_revision()
+}
+
+// VarRevision returns the etcd mod revision of a value as seen locally,
+// 0 if the store does not have it, for use with Transaction.IfRevision
+func (p *Store) VarRevision(path, key string) int64 {
+	return p.var_revision(path_join(p.root, path, key))
+}
+
+// Stale reports whether the store is not in sync with etcd, such as after
+// starting from the cache file while etcd is unreachable
+func (p *Store) Stale() bool {
+	return p.is_stale()
+}
+
+// Root returns the etcd directory the store follows
+func (p *Store) Root() string {
+	return p.root
+}
+
+func (p *Store) ServiceVarInt(category, service string) int {
+	return p.get_int(category, service)
+}
+
+func (p *Store) ServiceVarStr(category, service string) string {
+	return p.get_str(category, service)
+}
+
+func (p *Store) ExecuteGroupInt(category string, f func(map[string]int)) {
+	p.exec_group_int(category, f)
+}
+
+func (p *Store) ExecuteGroupStr(category string, f func(map[string]string)) {
+	p.exec_group_str(category, f)
+}
+
+// SetServiceVar writes value under path for the store's own service id
+func (p *Store) SetServiceVar(ctx context.Context, path, value string) error {
+	return p.UpdateGlobalVar(ctx, path, p.service_id, value)
+}
+
+func (p *Store) UpdateGlobalVar(ctx context.Context, path, key, value string) error {
+	return p.update(ctx, path_join(p.root, path, key), value)
+}
+
+// RegisterCallback receives the keys changed anywhere below path,
+// path "" registers on the whole root
+func (p *Store) RegisterCallback(path string, callback chan string) {
+	p.register_callback(strings.TrimSuffix(path_join(p.root, path), "/"), callback)
+}
+
+func Stale() bool {
+	return _default_server.Stale()
+}
+
+func Revision() int64 {
+	return _default_server.Revision()
+}
+
+func VarRevision(path, key string) int64 {
+	return _default_server.VarRevision(path, key)
+}
+
 func ServiceVarInt(category, service string) int {
-	return _default_server.get_int(category, service)
+	return _default_server.ServiceVarInt(category, service)
 }
 
 func ServiceVarStr(category, service string) string {
-	return _default_server.get_str(category, service)
+	return _default_server.ServiceVarStr(category, service)
 }
 
 func ExecuteGroupInt(category string, f func(map[string]int)) {
-	_default_server.exec_group_int(category, f)
+	_default_server.ExecuteGroupInt(category, f)
 }
 
 func ExecuteGroupStr(category string, f func(map[string]string)) {
-	_default_server.exec_group_str(category, f)
+	_default_server.ExecuteGroupStr(category, f)
 }
 
 func SetServiceVar(path, value string) error {
-	return UpdateGlobalVar(path, _default_server.service_id, value)
+	return _default_server.SetServiceVar(context.Background(), path, value)
 }
 
 func UpdateGlobalVar(path, key, value string) error {
-	return _default_server.update(path_join(_default_server.root, path, key), value)
+	return _default_server.UpdateGlobalVar(context.Background(), path, key, value)
 }
 
 func RegisterCallback(path string, callback chan string) {
-	_default_server.register_callback(path_join(_default_server.root, path), callback)
+	_default_server.RegisterCallback(path, callback)
 }
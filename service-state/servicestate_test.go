@@ -0,0 +1,1056 @@
+package servicestate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	log "github.com/sirupsen/logrus"
+)
+
+var endpoints []string = []string{"http://127.0.0.1:23791"}
+
+// an embedded etcd, so the tests need no external cluster
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	client_url, _ := url.Parse(endpoints[0])
+	peer_url, _ := url.Parse("http://127.0.0.1:23801")
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*client_url}, []url.URL{*client_url}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peer_url}, []url.URL{*peer_url}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	<-etcd.Server.ReadyNotify()
+
+	code := m.Run()
+
+	etcd.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func client(t *testing.T) *clientv3.Client {
+	c, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func put(t *testing.T, key, value string) int64 {
+	c := client(t)
+	defer c.Close()
+
+	resp, err := c.Put(context.Background(), key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Header.Revision
+}
+
+func del(t *testing.T, key string) int64 {
+	c := client(t)
+	defer c.Close()
+
+	resp, err := c.Delete(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Header.Revision
+}
+
+func wait(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestStores(t *testing.T) {
+	put(t, "/tenant1/"+NUMBER_PREFIX_NODE, "online")
+	put(t, "/tenant1/online/game1", "10")
+	put(t, "/tenant2/addr/game1", "127.0.0.1")
+
+	ctx := context.Background()
+	s1, err := NewStore(ctx, "/tenant1", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := NewStore(ctx, "/tenant2", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := s1.ServiceVarInt("online", "game1"); v != 10 {
+		t.Fatalf("online = %v", v)
+	}
+	if v := s2.ServiceVarStr("addr", "game1"); v != "127.0.0.1" {
+		t.Fatalf("addr = %v", v)
+	}
+
+	if err := s1.SetServiceVar(ctx, "online", "11"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s1.ServiceVarInt("online", "game1") == 11 })
+	if v := s2.ServiceVarInt("online", "game1"); v != -1 {
+		t.Fatalf("tenant2 online = %v", v)
+	}
+
+	s1.Close()
+	s2.Close()
+
+	// closed stores keep their values but no longer follow etcd
+	put(t, "/tenant1/online/game1", "12")
+	time.Sleep(100 * time.Millisecond)
+	if v := s1.ServiceVarInt("online", "game1"); v != 11 {
+		t.Fatalf("closed store online = %v", v)
+	}
+}
+
+func TestRevision(t *testing.T) {
+	put(t, "/revision/addr/game1", "127.0.0.1")
+
+	s, err := NewStore(context.Background(), "/revision", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	rev := put(t, "/revision/addr/game2", "127.0.0.2")
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("addr", "game2"); v != "127.0.0.2" {
+		t.Fatalf("addr game2 = %v", v)
+	}
+
+	rev = del(t, "/revision/addr/game1")
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("addr", "game1"); v != "" {
+		t.Fatalf("deleted addr game1 = %v", v)
+	}
+
+	// a sibling root sharing the prefix is not followed
+	put(t, "/revision2/addr/game3", "127.0.0.3")
+	if v := s.ServiceVarStr("addr", "game3"); v != "" {
+		t.Fatalf("sibling addr game3 = %v", v)
+	}
+}
+
+func TestResync(t *testing.T) {
+	put(t, "/resync/addr/game1", "127.0.0.1")
+	put(t, "/resync/addr/game2", "127.0.0.2")
+
+	s, err := NewStore(context.Background(), "/resync", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// stop the watcher only
+	s.cancel()
+	s.wg.Wait()
+
+	// changes made while the store was not watching are picked up by a resync
+	del(t, "/resync/addr/game1")
+	rev := put(t, "/resync/addr/game2", "127.0.0.3")
+	if err := s.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Revision() < rev {
+		t.Fatalf("revision %v < %v", s.Revision(), rev)
+	}
+	if v := s.ServiceVarStr("addr", "game1"); v != "" {
+		t.Fatalf("deleted addr game1 = %v", v)
+	}
+	if v := s.ServiceVarStr("addr", "game2"); v != "127.0.0.3" {
+		t.Fatalf("addr game2 = %v", v)
+	}
+}
+
+// gated_watcher holds back the watches until open is closed and tells which
+// were answered with a compaction
+type gated_watcher struct {
+	clientv3.Watcher
+	entered   chan struct{} // one per watch
+	open      chan struct{}
+	compacted chan struct{} // one per compacted watch
+}
+
+func (w *gated_watcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	w.entered <- struct{}{}
+	select {
+	case <-w.open:
+	case <-ctx.Done():
+	}
+
+	in, out := w.Watcher.Watch(ctx, key, opts...), make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(out)
+		for resp := range in {
+			if resp.CompactRevision != 0 {
+				w.compacted <- struct{}{}
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func TestCompacted(t *testing.T) {
+	put(t, "/compacted/addr/game1", "127.0.0.1")
+	put(t, "/compacted/addr/game2", "127.0.0.2")
+
+	s, err := NewStore(context.Background(), "/compacted", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// restart the watcher on a watch held back at the store's revision
+	s.cancel()
+	s.wg.Wait()
+	gate := &gated_watcher{
+		Watcher:   s.client.Watcher,
+		entered:   make(chan struct{}, 10),
+		open:      make(chan struct{}),
+		compacted: make(chan struct{}, 10),
+	}
+	s.client.Watcher = gate
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.wg.Add(1)
+	go s.watcher()
+	<-gate.entered
+	from := s.Revision()
+
+	// the revisions the watch starts from are compacted meanwhile
+	del(t, "/compacted/addr/game1")
+	rev := put(t, "/compacted/addr/game2", "127.0.0.3")
+	c := client(t)
+	defer c.Close()
+	if _, err := c.Compact(context.Background(), rev, clientv3.WithCompactPhysical()); err != nil {
+		t.Fatal(err)
+	}
+	if rev <= from {
+		t.Fatalf("compacted %v before %v", rev, from)
+	}
+	close(gate.open)
+
+	// the store resyncs and watches again
+	select {
+	case <-gate.compacted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not compacted")
+	}
+	select {
+	case <-gate.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not started again")
+	}
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("addr", "game1"); v != "" {
+		t.Fatalf("deleted addr game1 = %v", v)
+	}
+	if v := s.ServiceVarStr("addr", "game2"); v != "127.0.0.3" {
+		t.Fatalf("addr game2 = %v", v)
+	}
+
+	put(t, "/compacted/addr/game3", "127.0.0.4")
+	wait(t, func() bool { return s.ServiceVarStr("addr", "game3") == "127.0.0.4" })
+}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewStore(ctx, "/txn", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Txn().Create("addr", "game1", "127.0.0.1").Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Txn().Create("addr", "game1", "127.0.0.2").Commit(ctx); err != ErrTxnFailed {
+		t.Fatalf("create existing err %v", err)
+	}
+
+	// unchanged values are not an error
+	if err := s.SetServiceVar(ctx, "addr", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed condition leaves every key untouched
+	_, err = s.Txn().
+		CompareAndSwap("addr", "game1", "127.0.0.9", "127.0.0.2").
+		Set("port", "game1", "8080").
+		Commit(ctx)
+	if err != ErrTxnFailed {
+		t.Fatalf("cas err %v", err)
+	}
+
+	rev, err := s.Txn().
+		CompareAndSwap("addr", "game1", "127.0.0.1", "127.0.0.2").
+		Set("port", "game1", "8080").
+		Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("addr", "game1"); v != "127.0.0.2" {
+		t.Fatalf("addr = %v", v)
+	}
+	if v := s.ServiceVarStr("port", "game1"); v != "8080" {
+		t.Fatalf("port = %v", v)
+	}
+	if v := s.VarRevision("port", "game1"); v != rev {
+		t.Fatalf("port revision %v != %v", v, rev)
+	}
+
+	// revision compare, then delete and ttl bound values
+	_, err = s.Txn().
+		IfRevision("port", "game1", rev-1).
+		Delete("port", "game1").
+		Commit(ctx)
+	if err != ErrTxnFailed {
+		t.Fatalf("stale revision err %v", err)
+	}
+
+	rev, err = s.Txn().
+		IfRevision("port", "game1", rev).
+		Delete("port", "game1").
+		SetWithTTL("online", "game1", "1", time.Minute).
+		Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("port", "game1"); v != "" {
+		t.Fatalf("deleted port = %v", v)
+	}
+
+	c := client(t)
+	defer c.Close()
+	resp, err := c.Get(ctx, "/txn/online/game1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || resp.Kvs[0].Lease == 0 {
+		t.Fatalf("online not bound to a lease %v", resp.Kvs)
+	}
+}
+
+func TestHierarchy(t *testing.T) {
+	put(t, "/tree/"+NUMBER_PREFIX_NODE, "limits")
+	put(t, "/tree/limits/match/rank/game1", "100")
+	put(t, "/tree/limits/match/casual/game1", "200")
+	put(t, "/tree/addr/game1", "127.0.0.1")
+
+	s, err := NewStore(context.Background(), "/tree", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if v := s.ServiceVarInt("limits/match/rank", "game1"); v != 100 {
+		t.Fatalf("rank limit = %v", v)
+	}
+	if v := s.ServiceVarStr("addr", "game1"); v != "127.0.0.1" {
+		t.Fatalf("addr = %v", v)
+	}
+
+	if v := s.Subtree("limits/match"); len(v) != 2 || v["limits/match/casual/game1"] != "200" {
+		t.Fatalf("subtree = %v", v)
+	}
+	if v := s.Subtree(""); len(v) != 3 {
+		t.Fatalf("whole tree = %v", v)
+	}
+	if v := s.Glob("limits/*/rank/*"); len(v) != 1 {
+		t.Fatalf("glob = %v", v)
+	}
+	if v := s.Glob("**/game1"); len(v) != 3 {
+		t.Fatalf("glob ** = %v", v)
+	}
+
+	// callbacks on an upper level see the initial keys and deeper changes
+	callback := make(chan string, 10)
+	s.RegisterCallback("limits", callback)
+	for i := 0; i < 2; i++ {
+		<-callback
+	}
+
+	put(t, "/tree/limits/match/rank/game2", "300")
+	if key := <-callback; key != "/tree/limits/match/rank/game2" {
+		t.Fatalf("callback key = %v", key)
+	}
+}
+
+func TestCache(t *testing.T) {
+	put(t, "/cache/"+NUMBER_PREFIX_NODE, "online")
+	put(t, "/cache/online/game1", "10")
+
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/cache.json"
+
+	ctx := context.Background()
+	s, err := NewStore(ctx, "/cache", "game1", endpoints, WithCacheFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// etcd down at startup
+	unreachable := []string{"http://127.0.0.1:1"}
+	s, err = NewStore(ctx, "/cache", "game1", unreachable, WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Stale() || s.ServiceVarStr("online", "game1") != "" {
+		t.Fatalf("empty store stale %v online %v", s.Stale(), s.ServiceVarStr("online", "game1"))
+	}
+	s.client.SetEndpoints(endpoints...)
+	wait(t, func() bool { return !s.Stale() })
+	if v := s.ServiceVarInt("online", "game1"); v != 10 {
+		t.Fatalf("online = %v", v)
+	}
+	s.Close()
+
+	// a cache of another root is ignored
+	s, err = NewStore(ctx, "/other", "game1", unreachable, WithTimeout(100*time.Millisecond), WithCacheFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Stale() || len(s.Subtree("")) != 0 {
+		t.Fatalf("store of another root stale %v values %v", s.Stale(), s.Subtree(""))
+	}
+	s.Close()
+
+	s, err = NewStore(ctx, "/cache", "game1", unreachable, WithTimeout(100*time.Millisecond), WithCacheFile(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if !s.Stale() {
+		t.Fatal("cached store not stale")
+	}
+	if v := s.ServiceVarInt("online", "game1"); v != 10 {
+		t.Fatalf("cached online = %v", v)
+	}
+
+	// etcd back, the store catches up in the background
+	put(t, "/cache/online/game1", "11")
+	s.client.SetEndpoints(endpoints...)
+	wait(t, func() bool { return !s.Stale() })
+	if v := s.ServiceVarInt("online", "game1"); v != 11 {
+		t.Fatalf("online = %v", v)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	put(t, "/subscribe/addr/game1", "127.0.0.1")
+
+	s, err := NewStore(context.Background(), "/subscribe", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := s.Subscribe(ctx, "addr")
+	if ev := <-events; ev.Type != EventSet || ev.Key != "addr/game1" || ev.NewValue != "127.0.0.1" {
+		t.Fatalf("initial event %+v", ev)
+	}
+
+	rev := put(t, "/subscribe/addr/game1", "127.0.0.2")
+	if ev := <-events; ev.Type != EventSet || ev.OldValue != "127.0.0.1" || ev.NewValue != "127.0.0.2" || ev.Revision != rev {
+		t.Fatalf("set event %+v", ev)
+	}
+
+	put(t, "/subscribe/port/game1", "8080")
+	rev = del(t, "/subscribe/addr/game1")
+	if ev := <-events; ev.Type != EventDelete || ev.Key != "addr/game1" || ev.OldValue != "127.0.0.2" || ev.Revision != rev {
+		t.Fatalf("delete event %+v", ev)
+	}
+
+	// a subscriber that falls behind gets a resync instead of blocking the store
+	for i := 0; i <= SUBSCRIBE_BUFFER; i++ {
+		s.set("/subscribe/addr/game2", fmt.Sprint(i), rev)
+	}
+	if ev := <-events; ev.Type != EventResync {
+		t.Fatalf("overflow event %+v", ev)
+	}
+	if ev := <-events; ev.Type != EventSet || ev.NewValue != fmt.Sprint(SUBSCRIBE_BUFFER) {
+		t.Fatalf("resync event %+v", ev)
+	}
+
+	cancel()
+	for range events {
+	}
+}
+
+type counter_statter struct {
+	counters map[string]int
+}
+
+func (s *counter_statter) Counter(sampleRate float32, bucket string, n ...int) {
+	s.counters[bucket] += n[0]
+}
+
+func (s *counter_statter) Gauge(sampleRate float32, bucket string, value ...string) {}
+
+func TestValidate(t *testing.T) {
+	put(t, "/validate/"+NUMBER_PREFIX_NODE, "online")
+	put(t, "/validate/online/game1", "10")
+	put(t, "/validate/addr/game1", "127.0.0.1")
+
+	ctx := context.Background()
+	statter := &counter_statter{counters: make(map[string]int)}
+	s, err := NewStore(ctx, "/validate", "game1", endpoints,
+		WithStatter(statter),
+		WithValidator("online", IntRange(0, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.RegisterValidator("addr/*", MatchRegexp(`^\d+\.\d+\.\d+\.\d+$`))
+
+	events := s.Subscribe(ctx, "")
+	for i := 0; i < 2; i++ {
+		<-events
+	}
+
+	for _, value := range []string{"1000", "ten"} {
+		put(t, "/validate/online/game1", value)
+		if ev := <-events; ev.Type != EventRejected || ev.OldValue != "10" || ev.NewValue != value {
+			t.Fatalf("rejected event %+v", ev)
+		}
+	}
+	if v := s.ServiceVarInt("online", "game1"); v != 10 {
+		t.Fatalf("online = %v", v)
+	}
+	if v := s.Rejected(); v["online/game1"] != "ten" {
+		t.Fatalf("rejected = %v", v)
+	}
+	if statter.counters["servicestate.rejected"] != 2 {
+		t.Fatalf("counters = %v", statter.counters)
+	}
+
+	put(t, "/validate/online/game1", "20")
+	if ev := <-events; ev.Type != EventSet || ev.OldValue != "10" || ev.NewValue != "20" {
+		t.Fatalf("set event %+v", ev)
+	}
+	if v := s.Rejected(); len(v) != 0 {
+		t.Fatalf("rejected = %v", v)
+	}
+
+	// writers run the same checks
+	if err := s.ValidateAndSet(ctx, "addr", "game1", "localhost"); err == nil {
+		t.Fatal("invalid addr written")
+	}
+	if err := s.ValidateAndSet(ctx, "addr", "game1", "127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-events; ev.Type != EventSet || ev.NewValue != "127.0.0.2" {
+		t.Fatalf("set event %+v", ev)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewStore(ctx, "/history", "game1", endpoints, WithWriter("tester"), WithHistory("limit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, value := range []string{"1", "2", "3"} {
+		if err := s.SetServiceVar(ctx, "limit", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a deeper variable keeps its own history
+	if err := s.UpdateGlobalVar(ctx, "limit/game1", "sub", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := s.History(ctx, "limit", "game1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("changes = %+v", changes)
+	}
+	if c := changes[1]; c.Writer != "tester" || c.OldValue != "1" || c.NewValue != "2" {
+		t.Fatalf("change = %+v", c)
+	}
+
+	if err := s.Rollback(ctx, "limit", "game1", changes[0].Revision); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s.ServiceVarStr("limit", "game1") == "1" })
+
+	changes, _ = s.History(ctx, "limit", "game1")
+	if c := changes[len(changes)-1]; c.OldValue != "3" || c.NewValue != "1" {
+		t.Fatalf("rollback change = %+v", c)
+	}
+	if _, err := s.ValueAt(ctx, "limit", "game1", changes[0].Revision-1); err == nil {
+		t.Fatal("value before the history")
+	}
+
+	// a write by a store without the history leaves the values after it unknown
+	s2, err := NewStore(ctx, "/history", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.SetServiceVar(ctx, "limit", "9"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s.ServiceVarStr("limit", "game1") == "9" })
+	rev := s.VarRevision("limit", "game1")
+	if v, err := s.ValueAt(ctx, "limit", "game1", rev); err == nil {
+		t.Fatalf("value at an unrecorded write %v", v)
+	}
+	if err := s.Rollback(ctx, "limit", "game1", rev); err == nil {
+		t.Fatal("rollback to an unrecorded write")
+	}
+	if v, err := s.ValueAt(ctx, "limit", "game1", changes[0].Revision); err != nil || v != "1" {
+		t.Fatalf("value at %v err %v", v, err)
+	}
+	if err := s.SetServiceVar(ctx, "limit", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ValueAt(ctx, "limit", "game1", rev); err == nil {
+		t.Fatal("value at an unrecorded write followed by a recorded one")
+	}
+	changes, _ = s.History(ctx, "limit", "game1")
+	if v, err := s.ValueAt(ctx, "limit", "game1", changes[len(changes)-1].Revision); err != nil || v != "5" {
+		t.Fatalf("latest value %v err %v", v, err)
+	}
+
+	// the other variables have no history
+	if err := s.SetServiceVar(ctx, "load", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := s.History(ctx, "load", "game1"); err != nil || len(changes) != 0 {
+		t.Fatalf("load history %+v err %v", changes, err)
+	}
+
+	// a record from a writer whose clock is ahead is still pruned first
+	put(t, "/history.history/limit/game2/99999999999999999999", `{"writer":"ahead","new":"0"}`)
+	for i := 1; i <= HISTORY_LIMIT; i++ {
+		if err := s.UpdateGlobalVar(ctx, "limit", "game2", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err = s.History(ctx, "limit", "game2")
+	if err != nil || len(changes) != HISTORY_LIMIT {
+		t.Fatalf("%v changes err %v", len(changes), err)
+	}
+	if first, last := changes[0], changes[len(changes)-1]; first.NewValue != "1" || last.NewValue != strconv.Itoa(HISTORY_LIMIT) {
+		t.Fatalf("first %+v last %+v", first, last)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := dir + "/schema.yaml"
+	ioutil.WriteFile(file, []byte(`
+rules:
+  - pattern: online
+    type: int
+    min: 0
+  - pattern: mode/*
+    enum: [rank, casual]
+`), 0644)
+
+	schema, err := LoadSchema(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(context.Background(), "/schema", "game1", endpoints, WithSchema(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, c := range []struct {
+		path, value string
+		ok          bool
+	}{
+		{"online", "10", true},
+		{"online", "-1", false},
+		{"online", "ten", false},
+		{"mode", "rank", true},
+		{"mode", "solo", false},
+	} {
+		if err := s.Validate(c.path, "game1", c.value); (err == nil) != c.ok {
+			t.Fatalf("validate %v = %v err %v", c.path, c.value, err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	put(t, "/stats/"+NUMBER_PREFIX_NODE, "load")
+	put(t, "/stats/load/game1", "30")
+	put(t, "/stats/load/game2", "10")
+	put(t, "/stats/load/game3", "20")
+
+	s, err := NewStore(context.Background(), "/stats", "game1", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	stats, ok := s.GroupStats("load")
+	if !ok || stats.Count != 3 || stats.Sum != 60 || stats.Mean != 20 ||
+		stats.Min != (ServiceValue{"game2", 10}) || stats.Max != (ServiceValue{"game1", 30}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	put(t, "/stats/load/game1", "5")
+	rev := del(t, "/stats/load/game2")
+	wait(t, func() bool { return s.Revision() >= rev })
+
+	if v, _ := s.LeastLoaded("load"); v != (ServiceValue{"game1", 5}) {
+		t.Fatalf("least loaded = %+v", v)
+	}
+	if v := s.TopN("load", 5); len(v) != 2 || v[0] != (ServiceValue{"game3", 20}) {
+		t.Fatalf("top = %+v", v)
+	}
+	if v := s.TopN("load", -1); len(v) != 0 {
+		t.Fatalf("top -1 = %+v", v)
+	}
+	if stats, _ := s.GroupStats("load"); stats.Sum != 25 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if _, ok := s.GroupStats("addr"); ok {
+		t.Fatal("stats of an empty category")
+	}
+}
+
+func TestEphemeral(t *testing.T) {
+	ctx := context.Background()
+	observer, err := NewStore(ctx, "/ephemeral", "observer", endpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Close()
+
+	s, err := NewStore(ctx, "/ephemeral", "game1", endpoints, WithEphemeralTTL(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetEphemeralVar(ctx, "online", "10"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return observer.ServiceVarStr("online", "game1") == "10" })
+
+	// a lost lease is replaced and the values written again
+	c := client(t)
+	defer c.Close()
+	if _, err := c.Revoke(ctx, s.ephemeral_lease); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return observer.ServiceVarStr("online", "game1") == "" })
+	wait(t, func() bool { return observer.ServiceVarStr("online", "game1") == "10" })
+
+	// overwritten, deleted or dropped values are not written again
+	for _, key := range []string{"game2", "game3", "game4"} {
+		if err := s.UpdateEphemeralVar(ctx, "addr", key, "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.UpdateGlobalVar(ctx, "addr", "game2", "127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Txn().Delete("addr", "game3").Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteEphemeralVar(ctx, "addr", "game4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Revoke(ctx, s.ephemeral_lease); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return observer.ServiceVarStr("online", "game1") == "" })
+	wait(t, func() bool { return observer.ServiceVarStr("online", "game1") == "10" })
+	if addrs := observer.Subtree("addr"); len(addrs) != 1 || addrs["addr/game2"] != "127.0.0.2" {
+		t.Fatalf("addrs %v", addrs)
+	}
+
+	// closing the store removes its ephemeral values
+	callback := make(chan string, 10)
+	observer.RegisterCallback("online", callback)
+	<-callback
+	s.Close()
+	if key := <-callback; key != "/ephemeral/online/game1" || observer.ServiceVarStr("online", "game1") != "" {
+		t.Fatalf("callback %v, online = %v", key, observer.ServiceVarStr("online", "game1"))
+	}
+}
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := dir + "/values.toml"
+	ioutil.WriteFile(file, []byte(`
+[online]
+game1 = 20
+game2 = 30
+`), 0644)
+	os.Setenv("SERVICESTATE_TEST_online__game2", "40")
+	defer os.Unsetenv("SERVICESTATE_TEST_online__game2")
+
+	opts := []Option{
+		WithDefaults(map[string]string{"online/game1": "10", "addr/game1": "127.0.0.1"}),
+		WithFile(file),
+		WithEnv("SERVICESTATE_TEST_"),
+		WithNumberPrefixs("online"),
+	}
+
+	// without etcd
+	s, err := NewStore(context.Background(), "/layers", "game1", nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, c := range []struct{ service, value, layer string }{
+		{"game1", "20", LAYER_FILE},
+		{"game2", "40", LAYER_ENV},
+	} {
+		if v := s.ServiceVarInt("online", c.service); strconv.Itoa(v) != c.value {
+			t.Fatalf("online %v = %v", c.service, v)
+		}
+		if layer, _ := s.Origin("online", c.service); layer != c.layer {
+			t.Fatalf("online %v origin = %v", c.service, layer)
+		}
+	}
+	if layer, _ := s.Origin("addr", "game1"); layer != LAYER_DEFAULT {
+		t.Fatalf("addr origin = %v", layer)
+	}
+
+	// the file layer reloads, a key gone from the file falls back to the default
+	time.Sleep(10 * time.Millisecond)
+	ioutil.WriteFile(file, []byte(`
+[online]
+game2 = 50
+`), 0644)
+	for i := 0; i < 200 && s.ServiceVarInt("online", "game1") != 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if v := s.ServiceVarInt("online", "game1"); v != 10 {
+		t.Fatalf("reloaded online game1 = %v", v)
+	}
+	if stats, ok := s.GroupStats("online"); !ok || stats.Count != 2 || stats.Sum != 50 {
+		t.Fatalf("online stats %+v", stats)
+	}
+
+	// etcd has the highest precedence unless configured otherwise
+	put(t, "/layers/online/game2", "60")
+	s2, err := NewStore(context.Background(), "/layers", "game1", endpoints, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if layer, _ := s2.Origin("online", "game2"); layer != LAYER_ETCD || s2.ServiceVarInt("online", "game2") != 60 {
+		t.Fatalf("online game2 origin = %v", layer)
+	}
+
+	s3, err := NewStore(context.Background(), "/layers", "game1", endpoints,
+		append(opts, WithPrecedence(LAYER_ENV, LAYER_ETCD, LAYER_FILE, LAYER_DEFAULT))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Close()
+	if layer, _ := s3.Origin("online", "game2"); layer != LAYER_ENV {
+		t.Fatalf("online game2 origin = %v", layer)
+	}
+
+	rev := del(t, "/layers/online/game2")
+	wait(t, func() bool { return s2.Revision() >= rev })
+	if layer, _ := s2.Origin("online", "game2"); layer != LAYER_ENV {
+		t.Fatalf("online game2 origin after delete = %v", layer)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := dir + "/keys"
+	if err := GenerateKey(keys, "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []Option{WithKeyFile(keys), WithSecret("db"), WithSecret("api"), WithHistory("db")}
+	s, err := NewStore(context.Background(), "/secrets", "game1", endpoints, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := s.Subscribe(ctx, "db")
+
+	if err := s.UpdateGlobalVar(context.Background(), "db", "password", "s3cret"); err != nil {
+		t.Fatal(err)
+	}
+	wait(t, func() bool { return s.ServiceVarStr("db", "password") == "s3cret" })
+
+	// etcd, events, introspection and history never see the plaintext
+	resp, err := client(t).Get(context.Background(), "/secrets/db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := string(resp.Kvs[0].Value)
+	if !strings.HasPrefix(raw, SECRET_PREFIX+"k1:") || strings.Contains(raw, "s3cret") {
+		t.Fatalf("stored %v", raw)
+	}
+	if ev := <-events; ev.NewValue != REDACTED {
+		t.Fatalf("event %+v", ev)
+	}
+	if v := s.Subtree("db")["db/password"]; v != REDACTED {
+		t.Fatalf("subtree %v", v)
+	}
+	changes, err := s.History(context.Background(), "db", "password")
+	if err != nil || len(changes) != 1 || changes[0].NewValue != REDACTED {
+		t.Fatalf("history %+v err %v", changes, err)
+	}
+
+	// plaintext written behind the store's back is rejected
+	rev := put(t, "/secrets/db/password", "leaked")
+	wait(t, func() bool { return s.Revision() >= rev })
+	if v := s.ServiceVarStr("db", "password"); v != "s3cret" {
+		t.Fatalf("plaintext applied %v", v)
+	}
+	if v := s.Rejected()["db/password"]; v != REDACTED {
+		t.Fatalf("rejected %v", v)
+	}
+
+	// a ciphertext moved to another variable does not decrypt
+	rev = put(t, "/secrets/db/user", raw)
+	wait(t, func() bool { return s.Revision() >= rev })
+	if _, ok := s.Var("db", "user"); ok {
+		t.Fatal("moved ciphertext applied")
+	}
+
+	// rotation re-encrypts under the new primary key, the other store picks
+	// the new key up from the file
+	if _, err := s.Txn().Set("db", "password", "s3cret2").Set("db", "user", "admin").Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Txn().IfValue("db", "user", "admin").Commit(context.Background()); err == nil {
+		t.Fatal("compare on a secret value")
+	}
+	if err := s.UpdateGlobalVar(context.Background(), "api", "token", "t0ken"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKey(keys, "k2"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.RotateSecrets(context.Background())
+	if err != nil || n != 3 {
+		t.Fatalf("rotated %v err %v", n, err)
+	}
+	if changes, err := s.History(context.Background(), "api", "token"); err != nil || len(changes) != 0 {
+		t.Fatalf("api token history %+v err %v", changes, err)
+	}
+	resp, err = client(t).Get(context.Background(), "/secrets/db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw := string(resp.Kvs[0].Value); !strings.HasPrefix(raw, SECRET_PREFIX+"k2:") {
+		t.Fatalf("rotated %v", raw)
+	}
+	wait(t, func() bool { return s.Revision() >= resp.Header.Revision })
+	if v := s.ServiceVarStr("db", "password"); v != "s3cret2" {
+		t.Fatalf("db password = %v", v)
+	}
+	if v, err := s.ValueAt(context.Background(), "db", "user", resp.Header.Revision); err != nil || v != "admin" {
+		t.Fatalf("value at = %v err %v", v, err)
+	}
+
+	// no key file, no secret writes
+	s2, err := NewStore(context.Background(), "/secrets", "game1", endpoints, WithSecret("db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.UpdateGlobalVar(context.Background(), "db", "password", "x"); err == nil {
+		t.Fatal("secret written without key file")
+	}
+}
+
+func TestSecretValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := dir + "/keys"
+	if err := GenerateKey(keys, "k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore(context.Background(), "/secretvalidation", "game1", nil,
+		WithKeyFile(keys), WithSecret("pin"), WithNumberPrefixs("pin"), WithValidator("pin", IntRange(0, 9999)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// neither the number check nor the validators quote a secret
+	for _, value := range []string{"s3cret", "123456"} {
+		err := s.ValidateAndSet(context.Background(), "pin", "game1", value)
+		if err == nil || strings.Contains(err.Error(), value) {
+			t.Fatalf("validate err %v", err)
+		}
+	}
+}
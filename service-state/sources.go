@@ -0,0 +1,259 @@
+package servicestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	LAYER_DEFAULT = "default"
+	LAYER_FILE    = "file"
+	LAYER_ENV     = "env"
+	LAYER_ETCD    = "etcd"
+
+	SOURCE_POLL_INTERVAL = 2 * time.Second // how often reloadable sources are checked
+)
+
+// Source supplies the values of one layer, keyed by category/service relative
+// to the root. A source that also has a Changed() bool method is polled and
+// loaded again whenever it reports a change.
+type Source interface {
+	Layer() string
+	Load() (map[string]string, error)
+}
+
+type reloader interface {
+	Changed() bool
+}
+
+type layer_value struct {
+	value    string
+	revision int64 // etcd mod revision, 0 for the local layers
+}
+
+// WithSource adds a layer of values, see WithPrecedence for their order
+func WithSource(source Source) Option {
+	return func(p *Store) {
+		p.sources = append(p.sources, source)
+	}
+}
+
+// WithDefaults supplies the values of the default layer
+func WithDefaults(values map[string]string) Option {
+	return WithSource(defaults_source(values))
+}
+
+// WithFile supplies the file layer from a YAML, JSON or TOML file, see
+// LoadValues, the file is loaded again when it changes
+func WithFile(file string) Option {
+	return WithSource(&file_source{file: file})
+}
+
+// WithEnv supplies the env layer from the variables named prefix followed by
+// category/service, "/" written as "__", e.g. SERVICESTATE_online__game1=10,
+// the names are lowercased
+func WithEnv(prefix string) Option {
+	return WithSource(env_source(prefix))
+}
+
+// WithPrecedence orders the layers, highest first, the default order is
+// etcd, env, file, default
+func WithPrecedence(layers ...string) Option {
+	return func(p *Store) {
+		p.precedence = layers
+	}
+}
+
+type defaults_source map[string]string
+
+func (s defaults_source) Layer() string                    { return LAYER_DEFAULT }
+func (s defaults_source) Load() (map[string]string, error) { return s, nil }
+
+type env_source string
+
+func (s env_source) Layer() string { return LAYER_ENV }
+
+func (s env_source) Load() (map[string]string, error) {
+	values := make(map[string]string)
+	for _, env := range os.Environ() {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], string(s)) {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimPrefix(kv[0], string(s)))
+		values[strings.ReplaceAll(key, "__", "/")] = kv[1]
+	}
+
+	return values, nil
+}
+
+type file_source struct {
+	file    string
+	modtime time.Time
+}
+
+func (s *file_source) Layer() string { return LAYER_FILE }
+
+func (s *file_source) Load() (map[string]string, error) {
+	if info, err := os.Stat(s.file); err == nil {
+		s.modtime = info.ModTime()
+	}
+
+	return LoadValues(s.file)
+}
+
+func (s *file_source) Changed() bool {
+	info, err := os.Stat(s.file)
+	return err == nil && !info.ModTime().Equal(s.modtime)
+}
+
+// LoadValues reads category -> service -> value from a .json, .yaml, .yml or
+// .toml file and returns the values keyed by category/service
+func LoadValues(file string) (map[string]string, error) {
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree map[string]map[string]interface{}
+	switch filepath.Ext(file) {
+	case ".json":
+		err = json.Unmarshal(bytes, &tree)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(bytes, &tree)
+	case ".toml":
+		err = toml.Unmarshal(bytes, &tree)
+	default:
+		err = fmt.Errorf("unknown format %v", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for category, services := range tree {
+		for service, v := range services {
+			switch v := v.(type) {
+			case string:
+				values[category+"/"+service] = v
+			case float64:
+				values[category+"/"+service] = strconv.FormatFloat(v, 'f', -1, 64)
+			case int64:
+				values[category+"/"+service] = strconv.FormatInt(v, 10)
+			case bool:
+				values[category+"/"+service] = strconv.FormatBool(v)
+			default:
+				return nil, fmt.Errorf("%v/%v value %v is not a scalar", category, service, v)
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// load_sources fills the local layers and starts polling the reloadable ones
+func (p *Store) load_sources() error {
+	var reloadable []Source
+	for _, source := range p.sources {
+		values, err := source.Load()
+		if err != nil {
+			return fmt.Errorf("servicestate %v layer err %v", source.Layer(), err)
+		}
+
+		p.replace_layer(source.Layer(), values)
+		if _, ok := source.(reloader); ok {
+			reloadable = append(reloadable, source)
+		}
+	}
+
+	if len(reloadable) == 0 {
+		return nil
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(SOURCE_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-p.ctx.Done():
+				return
+			}
+
+			for _, source := range reloadable {
+				if !source.(reloader).Changed() {
+					continue
+				}
+
+				values, err := source.Load()
+				if err != nil {
+					log.Errorf("servicestate %v reload %v err %v", p.root, source.Layer(), err)
+					continue
+				}
+
+				p.replace_layer(source.Layer(), values)
+				log.Infof("servicestate %v reloaded %v layer", p.root, source.Layer())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// replace_layer swaps the content of a local layer and resolves the keys
+// that changed
+func (p *Store) replace_layer(layer string, values map[string]string) {
+	next := make(map[string]layer_value, len(values))
+	for k, v := range values {
+		key := path_join(p.root, k)
+		if _, _, err := p.path(key); err != nil {
+			log.Errorf("servicestate %v layer %v", layer, err)
+			continue
+		}
+
+		next[key] = layer_value{value: v}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prev := p.layers[layer]
+	p.layers[layer] = next
+	for key := range prev {
+		if _, ok := next[key]; !ok {
+			p.resolve(key, p.revision)
+		}
+	}
+
+	for key, v := range next {
+		if old, ok := prev[key]; !ok || old != v {
+			p.resolve(key, p.revision)
+		}
+	}
+}
+
+// Origin returns the layer that supplies the effective value of category/service
+func (p *Store) Origin(category, service string) (layer string, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	layer, ok = p.origins[path_join(p.root, category, service)]
+	return
+}
+
+func Origin(category, service string) (string, bool) {
+	return _default_server.Origin(category, service)
+}
@@ -0,0 +1,150 @@
+package servicestate
+
+import (
+	"sort"
+)
+
+// ServiceValue is the number of one service in a category
+type ServiceValue struct {
+	Service string
+	Value   int
+}
+
+// Stats aggregates the numbers of a category
+type Stats struct {
+	Count int
+	Sum   int
+	Min   ServiceValue
+	Max   ServiceValue
+	Mean  float64
+}
+
+// group_stats is maintained on every set and remove, the values are kept
+// sorted ascending, ties broken by service
+type group_stats struct {
+	sum    int
+	sorted []ServiceValue
+}
+
+func (g *group_stats) search(v ServiceValue) int {
+	return sort.Search(len(g.sorted), func(i int) bool {
+		s := g.sorted[i]
+		return s.Value > v.Value || s.Value == v.Value && s.Service >= v.Service
+	})
+}
+
+func (g *group_stats) insert(v ServiceValue) {
+	i := g.search(v)
+	g.sorted = append(g.sorted, ServiceValue{})
+	copy(g.sorted[i+1:], g.sorted[i:])
+	g.sorted[i] = v
+	g.sum += v.Value
+}
+
+func (g *group_stats) remove(v ServiceValue) {
+	i := g.search(v)
+	if i == len(g.sorted) || g.sorted[i] != v {
+		return
+	}
+
+	g.sorted = append(g.sorted[:i], g.sorted[i+1:]...)
+	g.sum -= v.Value
+}
+
+// stats_set replaces the number of service before it is stored, p.mu must be held
+func (p *Store) stats_set(category, service string, num int) {
+	g, ok := p.number_stats[category]
+	if !ok {
+		g = &group_stats{}
+		p.number_stats[category] = g
+	}
+
+	if old, ok := p.number_datas[category][service]; ok {
+		g.remove(ServiceValue{Service: service, Value: old})
+	}
+	g.insert(ServiceValue{Service: service, Value: num})
+}
+
+// stats_remove drops the number of service before it is deleted, p.mu must be held
+func (p *Store) stats_remove(category, service string) {
+	g, ok := p.number_stats[category]
+	if !ok {
+		return
+	}
+
+	if old, ok := p.number_datas[category][service]; ok {
+		g.remove(ServiceValue{Service: service, Value: old})
+	}
+}
+
+// GroupStats returns the count, sum, min, max and mean of the numbers of
+// category, ok is false when the category holds no numbers
+func (p *Store) GroupStats(category string) (stats Stats, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g := p.number_stats[category]
+	if g == nil || len(g.sorted) == 0 {
+		return
+	}
+
+	stats = Stats{
+		Count: len(g.sorted),
+		Sum:   g.sum,
+		Min:   g.sorted[0],
+		Max:   g.sorted[len(g.sorted)-1],
+		Mean:  float64(g.sum) / float64(len(g.sorted)),
+	}
+	return stats, true
+}
+
+// TopN returns the n services with the largest numbers of category, largest first
+func (p *Store) TopN(category string, n int) []ServiceValue {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g := p.number_stats[category]
+	if g == nil {
+		return nil
+	}
+
+	if n > len(g.sorted) {
+		n = len(g.sorted)
+	}
+	if n < 0 {
+		n = 0
+	}
+
+	top := make([]ServiceValue, 0, n)
+	for i := len(g.sorted) - 1; i >= len(g.sorted)-n; i-- {
+		top = append(top, g.sorted[i])
+	}
+
+	return top
+}
+
+// LeastLoaded returns the service with the smallest number of category,
+// for routing to the least loaded instance
+func (p *Store) LeastLoaded(category string) (v ServiceValue, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	g := p.number_stats[category]
+	if g == nil || len(g.sorted) == 0 {
+		return
+	}
+
+	return g.sorted[0], true
+}
+
+func GroupStats(category string) (Stats, bool) {
+	return _default_server.GroupStats(category)
+}
+
+func TopN(category string, n int) []ServiceValue {
+	return _default_server.TopN(category, n)
+}
+
+func LeastLoaded(category string) (ServiceValue, bool) {
+	return _default_server.LeastLoaded(category)
+}
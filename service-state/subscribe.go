@@ -0,0 +1,182 @@
+package servicestate
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	SUBSCRIBE_BUFFER = 1024 // events queued per subscription before it resyncs
+)
+
+type EventType int
+
+const (
+	EventSet      EventType = iota
+	EventDelete             // OldValue holds the removed value
+	EventResync             // the subscriber fell behind, the current values follow as EventSet
+	EventRejected           // NewValue failed validation, OldValue is kept
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventResync:
+		return "resync"
+	case EventRejected:
+		return "rejected"
+	}
+
+	return "unknown"
+}
+
+// Event is a change of one variable, Key is relative to the store root
+type Event struct {
+	Type     EventType
+	Key      string
+	OldValue string
+	NewValue string
+	Revision int64
+}
+
+// a change stream below prefix, events are queued without blocking the store
+// and delivered by the subscription's own goroutine
+type subscription struct {
+	prefix   string // full key prefix ending with "/"
+	queue    []Event
+	overflow bool          // queue dropped, a resync is due
+	signal   chan struct{} // queue not empty
+	mu       sync.Mutex
+}
+
+func (s *subscription) push(ev Event) {
+	s.mu.Lock()
+	if s.overflow {
+		s.mu.Unlock()
+		return
+	}
+
+	if len(s.queue) >= SUBSCRIBE_BUFFER {
+		s.queue, s.overflow = nil, true
+	} else {
+		s.queue = append(s.queue, ev)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// publish queues ev to the matching subscriptions with secrets redacted,
+// p.mu must be held
+func (p *Store) publish(ev Event) {
+	key := ev.Key
+	ev.Key = strings.TrimPrefix(key, p.root+"/")
+	ev.OldValue, ev.NewValue = p.redact(key, ev.OldValue), p.redact(key, ev.NewValue)
+	for s := range p.subscriptions {
+		if strings.HasPrefix(key, s.prefix) {
+			s.push(ev)
+		}
+	}
+}
+
+// snapshot returns the values below prefix as EventSet, p.mu must be held
+func (p *Store) snapshot(prefix string) []Event {
+	var events []Event
+	for k, v := range p.pathdatas {
+		if strings.HasPrefix(k, prefix) {
+			events = append(events, Event{
+				Type:     EventSet,
+				Key:      strings.TrimPrefix(k, p.root+"/"),
+				NewValue: p.redact(k, v),
+				Revision: p.pathrevisions[k],
+			})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Key < events[j].Key })
+	return events
+}
+
+// subscribe streams the current values below the full key path, then every
+// change, until ctx is cancelled or the store is closed
+func (p *Store) subscribe(ctx context.Context, path string) <-chan Event {
+	s := &subscription{
+		prefix: strings.TrimSuffix(path, "/") + "/",
+		signal: make(chan struct{}, 1),
+	}
+	out := make(chan Event)
+
+	p.mu.Lock()
+	s.queue = p.snapshot(s.prefix)
+	p.subscriptions[s] = true
+	p.mu.Unlock()
+	s.signal <- struct{}{}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(out)
+		defer func() {
+			p.mu.Lock()
+			delete(p.subscriptions, s)
+			p.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case <-s.signal:
+			case <-ctx.Done():
+				return
+			case <-p.ctx.Done():
+				return
+			}
+
+			// resync under the store lock so no change slips between
+			// the snapshot and the events queued after it
+			var events []Event
+			p.mu.RLock()
+			s.mu.Lock()
+			if s.overflow {
+				events = append([]Event{{Type: EventResync, Revision: p.revision}}, p.snapshot(s.prefix)...)
+				s.overflow = false
+			} else {
+				events = s.queue
+			}
+			s.queue = nil
+			s.mu.Unlock()
+			p.mu.RUnlock()
+
+			for _, ev := range events {
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				case <-p.ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// Subscribe streams the values below prefix, which is relative to the root,
+// as EventSet, followed by every change. A subscriber that falls more than
+// SUBSCRIBE_BUFFER events behind receives EventResync and the current values
+// again. The channel is closed when ctx is cancelled or the store is closed.
+func (p *Store) Subscribe(ctx context.Context, prefix string) <-chan Event {
+	return p.subscribe(ctx, path_join(p.root, prefix))
+}
+
+func Subscribe(ctx context.Context, prefix string) <-chan Event {
+	return _default_server.Subscribe(ctx, prefix)
+}
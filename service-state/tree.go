@@ -0,0 +1,83 @@
+package servicestate
+
+import (
+	"path"
+	"strings"
+)
+
+// Var returns the value of path/key whatever its type, secrets decrypted
+func (p *Store) Var(path, key string) (value string, ok bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	value, ok = p.pathdatas[path_join(p.root, path, key)]
+	return
+}
+
+// Subtree returns the values below prefix keyed by their path relative to
+// the root, prefix "" returns everything, secrets are redacted
+func (p *Store) Subtree(prefix string) map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	dir := strings.TrimSuffix(path_join(p.root, prefix), "/") + "/"
+	values := make(map[string]string)
+	for k, v := range p.pathdatas {
+		if strings.HasPrefix(k, dir) {
+			values[strings.TrimPrefix(k, p.root+"/")] = p.redact(k, v)
+		}
+	}
+
+	return values
+}
+
+// Glob returns the values whose path relative to the root matches pattern,
+// levels match as in path.Match and a "**" level matches any number of levels,
+// secrets are redacted
+func (p *Store) Glob(pattern string) map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	patterns := strings.Split(pattern, "/")
+	values := make(map[string]string)
+	for k, v := range p.pathdatas {
+		rel := strings.TrimPrefix(k, p.root+"/")
+		if glob_match(patterns, strings.Split(rel, "/")) {
+			values[rel] = p.redact(k, v)
+		}
+	}
+
+	return values
+}
+
+func glob_match(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if glob_match(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(names) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(patterns[0], names[0]); err != nil || !ok {
+			return false
+		}
+
+		patterns, names = patterns[1:], names[1:]
+	}
+
+	return len(names) == 0
+}
+
+func Subtree(prefix string) map[string]string {
+	return _default_server.Subtree(prefix)
+}
+
+func Glob(pattern string) map[string]string {
+	return _default_server.Glob(pattern)
+}
@@ -0,0 +1,172 @@
+package servicestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+var (
+	ErrTxnFailed = errors.New("servicestate txn conditions failed")
+)
+
+// Transaction collects conditions and writes on variables, Commit applies
+// all the writes when every condition holds and none of them otherwise
+type Transaction struct {
+	store *Store
+	cmps  []clientv3.Cmp
+	puts  []txn_put
+	dels  []string
+	err   error // of a write to a secret, returned by Commit
+}
+
+type txn_put struct {
+	key   string
+	value string
+	ttl   time.Duration // 0 for a value without lease
+}
+
+func (p *Store) Txn() *Transaction {
+	return &Transaction{store: p}
+}
+
+func (t *Transaction) key(path, key string) string {
+	return path_join(t.store.root, path, key)
+}
+
+// IfValue requires the variable to hold value, secrets are encrypted with a
+// random nonce so compare their revision instead
+func (t *Transaction) IfValue(path, key, value string) *Transaction {
+	full := t.key(path, key)
+	if t.store.is_secret(full) && t.err == nil {
+		t.err = fmt.Errorf("%v/%v is secret, compare its revision", path, key)
+	}
+
+	t.cmps = append(t.cmps, clientv3.Compare(clientv3.Value(full), "=", value))
+	return t
+}
+
+// IfRevision requires the variable to be last modified at revision,
+// see Store.VarRevision
+func (t *Transaction) IfRevision(path, key string, revision int64) *Transaction {
+	t.cmps = append(t.cmps, clientv3.Compare(clientv3.ModRevision(t.key(path, key)), "=", revision))
+	return t
+}
+
+// IfNotExists requires the variable to be absent
+func (t *Transaction) IfNotExists(path, key string) *Transaction {
+	t.cmps = append(t.cmps, clientv3.Compare(clientv3.CreateRevision(t.key(path, key)), "=", 0))
+	return t
+}
+
+func (t *Transaction) Set(path, key, value string) *Transaction {
+	return t.put(t.key(path, key), value, 0)
+}
+
+// SetWithTTL writes a value that etcd removes after ttl
+func (t *Transaction) SetWithTTL(path, key, value string, ttl time.Duration) *Transaction {
+	return t.put(t.key(path, key), value, ttl)
+}
+
+func (t *Transaction) Delete(path, key string) *Transaction {
+	t.dels = append(t.dels, t.key(path, key))
+	return t
+}
+
+// CompareAndSwap sets value if the variable still holds old
+func (t *Transaction) CompareAndSwap(path, key, old, value string) *Transaction {
+	return t.IfValue(path, key, old).Set(path, key, value)
+}
+
+// Create sets value if the variable does not exist yet
+func (t *Transaction) Create(path, key, value string) *Transaction {
+	return t.IfNotExists(path, key).Set(path, key, value)
+}
+
+func (t *Transaction) put(key, value string, ttl time.Duration) *Transaction {
+	value, err := t.store.seal(key, value)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+
+	t.puts = append(t.puts, txn_put{key: key, value: value, ttl: ttl})
+	return t
+}
+
+// Commit returns the revision of the writes, or ErrTxnFailed when a condition
+// does not hold, in which case nothing was written
+func (t *Transaction) Commit(ctx context.Context) (revision int64, err error) {
+	client := t.store.client
+	if client == nil {
+		return 0, fmt.Errorf("servicestate %v not initialized", t.store.root)
+	}
+
+	if t.err != nil {
+		return 0, t.err
+	}
+
+	// one lease per distinct ttl, dropped again if the txn does not apply
+	leases := make(map[time.Duration]clientv3.LeaseID)
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, id := range leases {
+			client.Revoke(context.Background(), id)
+		}
+	}()
+
+	var ops []clientv3.Op
+	for _, v := range t.puts {
+		if v.ttl <= 0 {
+			ops = append(ops, clientv3.OpPut(v.key, v.value))
+			continue
+		}
+
+		id, ok := leases[v.ttl]
+		if !ok {
+			var lease *clientv3.LeaseGrantResponse
+			lease, err = client.Grant(ctx, int64((v.ttl+time.Second-1)/time.Second))
+			if err != nil {
+				return
+			}
+
+			id = lease.ID
+			leases[v.ttl] = id
+		}
+
+		ops = append(ops, clientv3.OpPut(v.key, v.value, clientv3.WithLease(id)))
+	}
+
+	for _, key := range t.dels {
+		ops = append(ops, clientv3.OpDelete(key))
+	}
+
+	var resp *clientv3.TxnResponse
+	resp, err = client.Txn(ctx).If(t.cmps...).Then(ops...).Commit()
+	if err != nil {
+		return
+	}
+
+	if !resp.Succeeded {
+		err = ErrTxnFailed
+		return
+	}
+
+	keys := append([]string(nil), t.dels...)
+	for _, v := range t.puts {
+		keys = append(keys, v.key)
+	}
+	t.store.forget_ephemeral(keys...)
+
+	revision = resp.Header.Revision
+	return
+}
+
+func Txn() *Transaction {
+	return _default_server.Txn()
+}
@@ -0,0 +1,182 @@
+package servicestate
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validator checks a value before it is applied or written,
+// key is relative to the store root
+type Validator func(key, value string) error
+
+type validator struct {
+	pattern []string
+	f       Validator
+}
+
+type rejection struct {
+	value    string
+	revision int64
+}
+
+// Statter receives the store's metrics, g2s.Statter satisfies it
+type Statter interface {
+	Counter(sampleRate float32, bucket string, n ...int)
+	Gauge(sampleRate float32, bucket string, value ...string)
+}
+
+type noop_statter struct{}
+
+func (noop_statter) Counter(sampleRate float32, bucket string, n ...int)      {}
+func (noop_statter) Gauge(sampleRate float32, bucket string, value ...string) {}
+
+// IntRange accepts integers within [min, max]
+func IntRange(min, max int) Validator {
+	return func(key, value string) error {
+		num, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		if num < min || num > max {
+			return fmt.Errorf("%v out of range [%v, %v]", num, min, max)
+		}
+
+		return nil
+	}
+}
+
+// MatchRegexp accepts values matching expr, it panics if expr does not compile
+func MatchRegexp(expr string) Validator {
+	re := regexp.MustCompile(expr)
+	return func(key, value string) error {
+		if !re.MatchString(value) {
+			return fmt.Errorf("not matching %v", expr)
+		}
+
+		return nil
+	}
+}
+
+// validate checks value against the number type and the validators whose
+// pattern matches the key or its category, p.mu must be held. The errors of
+// a secret are replaced as they may quote the plaintext.
+func (p *Store) validate(key, category, value string) error {
+	err := p.check(key, category, value)
+	if err != nil && p.is_secret(key) {
+		return fmt.Errorf("secret failed validation")
+	}
+
+	return err
+}
+
+func (p *Store) check(key, category, value string) error {
+	if p.is_number_type(category) {
+		if _, err := strconv.Atoi(value); err != nil {
+			return err
+		}
+	}
+
+	rel := strings.Split(strings.TrimPrefix(key, p.root+"/"), "/")
+	categories := strings.Split(category, "/")
+	for _, v := range p.validators {
+		if !glob_match(v.pattern, rel) && !glob_match(v.pattern, categories) {
+			continue
+		}
+
+		if err := v.f(path_join(rel...), value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reject records a value held back by validation, p.mu must be held
+func (p *Store) reject(key, value string, revision int64, err error) {
+	if rejected, ok := p.rejected[key]; ok && rejected.revision == revision {
+		return
+	}
+
+	log.Errorf("servicestate reject %v = %v err %v", key, p.redact(key, value), err)
+	p.rejected[key] = rejection{value: value, revision: revision}
+	p.statter.Counter(1.0, "servicestate.rejected", 1)
+	p.statter.Gauge(1.0, "servicestate.rejected_keys", fmt.Sprint(len(p.rejected)))
+	p.publish(Event{Type: EventRejected, Key: key, OldValue: p.pathdatas[key], NewValue: value, Revision: revision})
+}
+
+// unreject forgets a held back value once key is set or deleted, p.mu must be held
+func (p *Store) unreject(key string) {
+	if _, ok := p.rejected[key]; !ok {
+		return
+	}
+
+	delete(p.rejected, key)
+	p.statter.Gauge(1.0, "servicestate.rejected_keys", fmt.Sprint(len(p.rejected)))
+}
+
+// RegisterValidator checks the values whose key or category, relative to the
+// root, matches pattern as in Store.Glob. Rejected values are not applied,
+// the previous value stays and subscribers receive EventRejected.
+func (p *Store) RegisterValidator(pattern string, v Validator) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.validators = append(p.validators, validator{pattern: strings.Split(pattern, "/"), f: v})
+}
+
+// Validate runs the checks a value written under path/key has to pass
+func (p *Store) Validate(path, key, value string) error {
+	full := path_join(p.root, path, key)
+	category, _, err := p.path(full)
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.validate(full, category, value)
+}
+
+// ValidateAndSet writes value only if it passes the store's validation
+func (p *Store) ValidateAndSet(ctx context.Context, path, key, value string) error {
+	if err := p.Validate(path, key, value); err != nil {
+		return fmt.Errorf("validate %v/%v err %v", path, key, err)
+	}
+
+	return p.UpdateGlobalVar(ctx, path, key, value)
+}
+
+// Rejected returns the values currently held back by validation,
+// keyed by their path relative to the root, secrets redacted
+func (p *Store) Rejected() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	values := make(map[string]string, len(p.rejected))
+	for k, v := range p.rejected {
+		values[strings.TrimPrefix(k, p.root+"/")] = p.redact(k, v.value)
+	}
+
+	return values
+}
+
+func RegisterValidator(pattern string, v Validator) {
+	_default_server.RegisterValidator(pattern, v)
+}
+
+func Validate(path, key, value string) error {
+	return _default_server.Validate(path, key, value)
+}
+
+func ValidateAndSet(path, key, value string) error {
+	return _default_server.ValidateAndSet(context.Background(), path, key, value)
+}
+
+func Rejected() map[string]string {
+	return _default_server.Rejected()
+}